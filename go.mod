@@ -9,4 +9,5 @@ require (
 	github.com/urfave/cli/v2 v2.3.0
 	golang.org/x/net v0.0.0-20211105192438-b53810dc28af
 	golang.org/x/sys v0.0.0-20210423082822-04245dca01da
+	gopkg.in/yaml.v2 v2.4.0
 )
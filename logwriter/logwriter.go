@@ -195,7 +195,7 @@ func (a *HourlySplit) Write(b []byte) (n int, err error) {
 		av := stat.Bavail * uint64(stat.Bsize)
 		if av < 1024*1024 {
 			fmt.Printf("avail size=%d", av)
-			fmt.Println("disk just avail %d bytes, urgent", av)
+			fmt.Printf("disk just avail %d bytes, urgent\n", av)
 			a.urgentLimit()
 		}
 	}
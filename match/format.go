@@ -0,0 +1,188 @@
+package match
+
+import (
+	"fmt"
+	"net"
+	"strings"
+)
+
+// 名单文件的格式，ParseLine把每种格式的一行转换为Matcher的规则
+const (
+	FormatRules   = "rules"   //Matcher的规则写法，包括正则表达式
+	FormatHosts   = "hosts"   //0.0.0.0 ads.example.com，只匹配名称本身
+	FormatAdblock = "adblock" //||ads.example.com^，@@开头为例外
+	FormatDnsmasq = "dnsmasq" //address=/ads.example.com/，匹配名称及其子域名
+	FormatDomains = "domains" //每行一个名称，只匹配名称本身
+)
+
+var formats = map[string]bool{FormatRules: true, FormatHosts: true, FormatAdblock: true, FormatDnsmasq: true, FormatDomains: true}
+
+// hosts文件中常见的本机名称，不作为规则
+var hostsLocalNames = map[string]bool{
+	"localhost": true, "localhost.localdomain": true, "local": true, "broadcasthost": true,
+	"ip6-localhost": true, "ip6-loopback": true, "ip6-localnet": true, "ip6-mcastprefix": true,
+	"ip6-allnodes": true, "ip6-allrouters": true, "ip6-allhosts": true, "0.0.0.0": true,
+}
+
+// IsFormat 是否为支持的格式
+func IsFormat(format string) bool {
+	return formats[format]
+}
+
+// DetectFormat 根据文件的前若干行判断格式：出现Adblock，dnsmasq或hosts写法时为对应格式，
+// 全部为名称时为domains，否则为rules
+func DetectFormat(lines []string) string {
+	domains := 0
+	for i, line := range lines {
+		if i >= 200 {
+			break
+		}
+		line = strings.TrimSpace(line)
+		if line == "" || line[0] == '#' || line[0] == '!' {
+			continue
+		}
+		switch fields := strings.Fields(stripComment(line)); {
+		case strings.HasPrefix(line, "||") || strings.HasPrefix(line, "@@") || strings.HasPrefix(line, "[Adblock"):
+			return FormatAdblock
+		case strings.HasPrefix(line, "address=/") || strings.HasPrefix(line, "server=/") || strings.HasPrefix(line, "local=/"):
+			return FormatDnsmasq
+		case len(fields) >= 2 && net.ParseIP(fields[0]) != nil:
+			return FormatHosts
+		case len(fields) == 1 && isDomain(strings.ToLower(fields[0])):
+			domains++
+		default:
+			return FormatRules
+		}
+	}
+	if domains > 0 {
+		return FormatDomains
+	}
+	return FormatRules
+}
+
+// ParseLine 把format格式的一行转换为Matcher的规则，注释和空行返回空
+func ParseLine(format, line string) ([]string, error) {
+	line = strings.TrimSpace(line)
+	if line == "" {
+		return nil, nil
+	}
+	switch format {
+	case FormatRules:
+		if line[0] == '#' || line[0] == '[' {
+			return nil, nil
+		}
+		return []string{line}, nil
+	case FormatHosts:
+		return parseHosts(line)
+	case FormatAdblock:
+		return parseAdblock(line)
+	case FormatDnsmasq:
+		return parseDnsmasq(line)
+	case FormatDomains:
+		fields := strings.Fields(stripComment(line))
+		if len(fields) == 0 {
+			return nil, nil
+		}
+		name := strings.ToLower(strings.TrimSuffix(fields[0], "."))
+		if len(fields) > 1 || !isDomain(name) {
+			return nil, fmt.Errorf("invalid domain %q", line)
+		}
+		return []string{name}, nil
+	}
+	return nil, fmt.Errorf("unknown list format %q", format)
+}
+
+func parseHosts(line string) ([]string, error) {
+	fields := strings.Fields(stripComment(line))
+	if len(fields) == 0 {
+		return nil, nil
+	}
+	if net.ParseIP(fields[0]) == nil || len(fields) < 2 {
+		return nil, fmt.Errorf("want <ip> <name>...: %q", line)
+	}
+	var rules []string
+	for _, name := range fields[1:] {
+		name = strings.ToLower(strings.TrimSuffix(name, "."))
+		if hostsLocalNames[name] {
+			continue
+		}
+		if !isDomain(name) {
+			return nil, fmt.Errorf("invalid domain %q", name)
+		}
+		rules = append(rules, name)
+	}
+	return rules, nil
+}
+
+func parseAdblock(line string) ([]string, error) {
+	if line[0] == '!' || line[0] == '[' || line[0] == '#' ||
+		strings.Contains(line, "##") || strings.Contains(line, "#@#") || strings.Contains(line, "#?#") {
+		return nil, nil //注释，文件头和元素隐藏规则，与DNS无关
+	}
+	prefix := ""
+	if strings.HasPrefix(line, "@@") {
+		prefix, line = "@@", line[2:]
+	}
+	if i := strings.Index(line, "$"); i >= 0 && !strings.HasPrefix(line, "/") {
+		line = line[:i] //$important等选项不影响DNS拦截
+	}
+	if len(line) > 2 && strings.HasPrefix(line, "/") && strings.HasSuffix(line, "/") {
+		return []string{prefix + line[1:len(line)-1]}, nil
+	}
+	name := strings.TrimSuffix(strings.TrimSuffix(strings.TrimPrefix(line, "||"), "|"), "^")
+	name = strings.ToLower(strings.TrimSuffix(name, "."))
+	if !isDomain(name) {
+		return nil, fmt.Errorf("unsupported adblock rule %q", line)
+	}
+	return []string{prefix + "||" + name + "^"}, nil
+}
+
+func parseDnsmasq(line string) ([]string, error) {
+	if line[0] == '#' {
+		return nil, nil
+	}
+	i := strings.Index(line, "=")
+	if i < 0 {
+		return nil, fmt.Errorf("unsupported dnsmasq line %q", line)
+	}
+	switch key := line[:i]; key {
+	case "address", "server", "local":
+	default:
+		return nil, fmt.Errorf("unsupported dnsmasq option %q", key)
+	}
+	parts := strings.Split(line[i+1:], "/")
+	if len(parts) < 3 || parts[0] != "" {
+		return nil, fmt.Errorf("want %v/<domain>/...: %q", line[:i+1], line)
+	}
+	//只有空地址、0.0.0.0、::和#表示拦截，其他地址是解析或转发，不支持
+	switch target := parts[len(parts)-1]; target {
+	case "", "0.0.0.0", "::", "#":
+	default:
+		return nil, fmt.Errorf("unsupported dnsmasq target %q", target)
+	}
+	var rules []string
+	for _, name := range parts[1 : len(parts)-1] {
+		name = strings.ToLower(strings.TrimSuffix(name, "."))
+		if !isDomain(name) {
+			return nil, fmt.Errorf("invalid domain %q", name)
+		}
+		rules = append(rules, "||"+name+"^")
+	}
+	return rules, nil
+}
+
+// Widen 把只匹配名称本身的规则改为同时匹配其子域名(||name^)，其他规则不变
+func Widen(rule string) string {
+	if isDomain(strings.ToLower(strings.TrimSuffix(rule, "."))) {
+		return "||" + strings.TrimSuffix(rule, ".") + "^"
+	}
+	return rule
+}
+
+// stripComment 去掉#之后的注释
+func stripComment(line string) string {
+	if i := strings.Index(line, "#"); i >= 0 {
+		return line[:i]
+	}
+	return line
+}
@@ -0,0 +1,78 @@
+package match
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestDetectFormat(t *testing.T) {
+	cases := []struct {
+		text, format string
+	}{
+		{"# hosts\n127.0.0.1 localhost\n0.0.0.0 ads.example.com\n", FormatHosts},
+		{"[Adblock Plus 2.0]\n! comment\n||ads.example.com^\n", FormatAdblock},
+		{"address=/ads.example.com/0.0.0.0\n", FormatDnsmasq},
+		{"ads.example.com\ntracker.example.org # comment\n", FormatDomains},
+		{"ads.example.com\n^ad[0-9]+\\.\n", FormatRules},
+		{"", FormatRules},
+	}
+	for _, c := range cases {
+		if f := DetectFormat(strings.Split(c.text, "\n")); f != c.format {
+			t.Errorf("%q: got %v, want %v", c.text, f, c.format)
+		}
+	}
+}
+
+func TestParseLine(t *testing.T) {
+	cases := []struct {
+		format, line string
+		rules        []string
+		err          bool
+	}{
+		{FormatHosts, "0.0.0.0 Ads.example.com. track.example.com # ads", []string{"ads.example.com", "track.example.com"}, false},
+		{FormatHosts, "127.0.0.1 localhost", nil, false},
+		{FormatHosts, "ads.example.com", nil, true},
+		{FormatAdblock, "||ads.example.com^$important", []string{"||ads.example.com^"}, false},
+		{FormatAdblock, "@@||good.example.com^", []string{"@@||good.example.com^"}, false},
+		{FormatAdblock, "example.com##.banner", nil, false},
+		{FormatAdblock, "/^ad[0-9]+\\./", []string{"^ad[0-9]+\\."}, false},
+		{FormatAdblock, "|https://example.com/ad.js", nil, true},
+		{FormatDnsmasq, "address=/ads.example.com/tracker.example.org/0.0.0.0", []string{"||ads.example.com^", "||tracker.example.org^"}, false},
+		{FormatDnsmasq, "address=/ads.example.com/", []string{"||ads.example.com^"}, false},
+		{FormatDnsmasq, "address=/ads.example.com/::", []string{"||ads.example.com^"}, false},
+		{FormatDnsmasq, "server=/ads.example.com/#", []string{"||ads.example.com^"}, false},
+		{FormatDnsmasq, "address=/intranet.example.com/10.0.0.1", nil, true},
+		{FormatDnsmasq, "server=/corp.example.com/192.168.1.1", nil, true},
+		{FormatDnsmasq, "conf-file=/etc/dnsmasq.conf", nil, true},
+		{FormatDomains, "ads.example.com", []string{"ads.example.com"}, false},
+		{FormatDomains, "ads example", nil, true},
+		{FormatRules, "[section]", nil, false},
+		{"csv", "ads.example.com", nil, true},
+	}
+	for _, c := range cases {
+		rules, err := ParseLine(c.format, c.line)
+		if (err != nil) != c.err || !reflect.DeepEqual(rules, c.rules) {
+			t.Errorf("%v %q: got %q %v", c.format, c.line, rules, err)
+		}
+	}
+}
+
+func TestAllow(t *testing.T) {
+	m := New()
+	for _, rule := range []string{"||example.com^", "@@||good.example.com^", "@@^cdn"} {
+		if err := m.Add(rule); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for name, blocked := range map[string]bool{
+		"ads.example.com":      true,
+		"good.example.com":     false,
+		"www.good.example.com": false,
+		"cdn.example.com":      false,
+	} {
+		if _, ok := m.Match(name); ok != blocked {
+			t.Errorf("%v: blocked=%v, want %v", name, ok, blocked)
+		}
+	}
+}
@@ -1,12 +1,185 @@
+// Package match 编译域名规则，查询时不再逐条执行正则表达式
 package match
 
-import "regexp"
+import (
+	"fmt"
+	"regexp"
+	"strings"
+	"sync"
+)
 
-func DomainMatch(domain string, m map[string]interface{}) bool {
-	for k, _ := range m {
-		if match, _ := regexp.MatchString(k, domain); match {
-			return true
+// Matcher 一组编译后的域名规则，支持以下写法：
+//
+//	example.com      只匹配example.com
+//	*.example.com    匹配example.com的子域名，不包括example.com
+//	||example.com^   匹配example.com及其子域名(Adblock写法)
+//	其他             正则表达式，匹配不含结尾.的名称
+//	@@<规则>         例外，与例外匹配的名称不会被其他规则匹配
+//
+// 前三种保存在按label倒序的后缀树中，正则表达式合并为一个后整体匹配。
+// Add全部完成后再调用Match，Match可以并发调用
+type Matcher struct {
+	root    node
+	res     []*regexp.Regexp
+	n       int
+	once    sync.Once
+	regexps *regexp.Regexp //所有正则表达式合并后的结果，第一次Match时编译
+	allow   *Matcher       //@@开头的例外
+}
+
+type node struct {
+	children map[string]*node
+	exact    string //以该节点结尾的名称的规则
+	suffix   string //该节点及其下所有名称的规则
+	sub      string //该节点下所有名称的规则，不包括该节点
+}
+
+// New 返回空的Matcher
+func New() *Matcher {
+	return &Matcher{}
+}
+
+// Add 添加一条规则，规则无效时返回错误
+func (m *Matcher) Add(rule string) error {
+	rule = strings.TrimSpace(rule)
+	if rule == "" {
+		return fmt.Errorf("empty rule")
+	}
+	if strings.HasPrefix(rule, "@@") {
+		if m.allow == nil {
+			m.allow = New()
+		}
+		if err := m.allow.Add(rule[2:]); err != nil {
+			return err
+		}
+		m.n++
+		return nil
+	}
+	lower := strings.ToLower(rule)
+	switch {
+	case strings.HasPrefix(lower, "||"):
+		name := strings.TrimSuffix(strings.TrimPrefix(lower, "||"), "^")
+		if !isDomain(name) {
+			return fmt.Errorf("invalid domain in rule %q", rule)
+		}
+		m.insert(name).suffix = rule
+	case strings.HasPrefix(lower, "*."):
+		name := lower[2:]
+		if !isDomain(name) {
+			return fmt.Errorf("invalid domain in rule %q", rule)
+		}
+		m.insert(name).sub = rule
+	case isDomain(lower):
+		m.insert(lower).exact = rule
+	default:
+		re, err := regexp.Compile(rule)
+		if err != nil {
+			return err
+		}
+		m.res = append(m.res, re)
+	}
+	m.n++
+	return nil
+}
+
+// Len 返回规则数
+func (m *Matcher) Len() int {
+	return m.n
+}
+
+// Match 返回与name匹配的规则，后缀树中的规则优先并且越具体越优先，name可以带结尾的.
+func (m *Matcher) Match(name string) (string, bool) {
+	name = strings.TrimSuffix(strings.ToLower(name), ".")
+	if m.allow != nil {
+		if _, ok := m.allow.Match(name); ok {
+			return "", false
+		}
+	}
+	if rule := m.lookup(name); rule != "" {
+		return rule, true
+	}
+	if len(m.res) == 0 {
+		return "", false
+	}
+	m.once.Do(m.compile)
+	if m.regexps != nil && !m.regexps.MatchString(name) {
+		return "", false
+	}
+	for _, re := range m.res {
+		if re.MatchString(name) {
+			return re.String(), true
+		}
+	}
+	return "", false
+}
+
+// compile 把所有正则表达式合并为一个，只用来快速判断是否有匹配，合并失败时逐条匹配
+func (m *Matcher) compile() {
+	parts := make([]string, len(m.res))
+	for i, re := range m.res {
+		parts[i] = "(?:" + re.String() + ")"
+	}
+	m.regexps, _ = regexp.Compile(strings.Join(parts, "|"))
+}
+
+func (m *Matcher) insert(name string) *node {
+	n := &m.root
+	labels := strings.Split(strings.TrimSuffix(name, "."), ".")
+	for i := len(labels) - 1; i >= 0; i-- {
+		child, ok := n.children[labels[i]]
+		if !ok {
+			if n.children == nil {
+				n.children = make(map[string]*node)
+			}
+			child = &node{}
+			n.children[labels[i]] = child
+		}
+		n = child
+	}
+	return n
+}
+
+func (m *Matcher) lookup(name string) string {
+	if name == "" {
+		return ""
+	}
+	var rule string
+	n := &m.root
+	labels := strings.Split(name, ".")
+	for i := len(labels) - 1; i >= 0; i-- {
+		if n.sub != "" { //还有label，说明name在n的下面
+			rule = n.sub
+		}
+		child, ok := n.children[labels[i]]
+		if !ok {
+			return rule
+		}
+		n = child
+		if n.suffix != "" {
+			rule = n.suffix
+		}
+	}
+	if n.exact != "" {
+		rule = n.exact
+	}
+	return rule
+}
+
+// isDomain 是否为只由字母，数字，-和_组成的名称
+func isDomain(name string) bool {
+	name = strings.TrimSuffix(name, ".")
+	if name == "" {
+		return false
+	}
+	for _, label := range strings.Split(name, ".") {
+		if label == "" || len(label) > 63 {
+			return false
+		}
+		for _, c := range label {
+			if !(c >= 'a' && c <= 'z' || c >= '0' && c <= '9' || c == '-' || c == '_') {
+				return false
+			}
 		}
 	}
-	return false
+	return true
 }
@@ -0,0 +1,70 @@
+package match
+
+import (
+	"fmt"
+	"testing"
+)
+
+func TestMatcher(t *testing.T) {
+	m := New()
+	for _, rule := range []string{
+		"example.com",
+		"*.wild.example.com",
+		"||ads.example.net^",
+		"||Tracker.ORG",
+		"exact.ads.example.net.",
+		`^cdn[0-9]+\.example\.io$`,
+		"(?i)evil",
+	} {
+		if err := m.Add(rule); err != nil {
+			t.Fatalf("add %q: %v", rule, err)
+		}
+	}
+	for _, rule := range []string{"", "||bad domain^", "*.", "a(b"} {
+		if m.Add(rule) == nil {
+			t.Errorf("invalid rule %q accepted", rule)
+		}
+	}
+	if m.Len() != 7 {
+		t.Errorf("got %v rules, want 7", m.Len())
+	}
+
+	cases := []struct {
+		name, rule string
+	}{
+		{"example.com.", "example.com"},
+		{"EXAMPLE.com", "example.com"},
+		{"www.example.com", ""},
+		{"wild.example.com", ""},
+		{"a.wild.example.com.", "*.wild.example.com"},
+		{"a.b.wild.example.com", "*.wild.example.com"},
+		{"ads.example.net", "||ads.example.net^"},
+		{"x.ads.example.net", "||ads.example.net^"},
+		{"exact.ads.example.net", "exact.ads.example.net."},
+		{"notads.example.net", ""},
+		{"pixel.tracker.org", "||Tracker.ORG"},
+		{"cdn12.example.io", `^cdn[0-9]+\.example\.io$`},
+		{"cdn.example.io", ""},
+		{"www.evil.com", "(?i)evil"},
+		{"", ""},
+	}
+	for _, c := range cases {
+		rule, ok := m.Match(c.name)
+		if rule != c.rule || ok != (c.rule != "") {
+			t.Errorf("match %q: got %q %v, want %q", c.name, rule, ok, c.rule)
+		}
+	}
+}
+
+func BenchmarkMatcher(b *testing.B) {
+	m := New()
+	for i := 0; i < 50000; i++ {
+		m.Add(fmt.Sprintf("||host%v.example.com^", i))
+	}
+	m.Add(`^ad[0-9]+\.`)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		m.Match("www.host49999.example.com.")
+		m.Match("www.miss.example.org.")
+	}
+}
@@ -1,6 +1,7 @@
 package main
 
 import (
+	"context"
 	"dns/api"
 	"dns/custom"
 	"dns/logwriter"
@@ -10,6 +11,8 @@ import (
 	"net"
 	"net/http"
 	"os"
+	"os/signal"
+	"syscall"
 	"time"
 
 	"github.com/sirupsen/logrus"
@@ -19,6 +22,9 @@ import (
 
 var Version = "manual build has no version"
 
+// shutdownTimeout 退出时等待进行中的REST请求的最长时间
+const shutdownTimeout = 5 * time.Second
+
 func main() {
 
 	app := &cli.App{
@@ -31,12 +37,47 @@ func main() {
 				Usage:  "start the server",
 				Action: serve,
 				Flags: []cli.Flag{
+					configFlag(),
+				},
+			},
+			{
+				Name:   "export",
+				Usage:  "export local records as json, yaml or zone file",
+				Action: exportRecords,
+				Flags: []cli.Flag{
+					configFlag(),
+					&cli.StringFlag{
+						Name:    "format",
+						Usage:   "json, yaml or zone, inferred from the output file name if not set",
+						Aliases: []string{"f"},
+					},
+					&cli.StringFlag{
+						Name:    "output",
+						Usage:   "output file, default stdout",
+						Aliases: []string{"o"},
+					},
+				},
+			},
+			{
+				Name:      "import",
+				Usage:     "import local records from a json, yaml or zone file",
+				ArgsUsage: "FILE",
+				Action:    importRecords,
+				Flags: []cli.Flag{
+					configFlag(),
+					&cli.StringFlag{
+						Name:    "format",
+						Usage:   "json, yaml or zone, inferred from the file name if not set",
+						Aliases: []string{"f"},
+					},
 					&cli.StringFlag{
-						Name:     "config",
-						Usage:    "config file",
-						Required: true,
-						Aliases:  []string{"c"},
-						EnvVars:  []string{"DNS_SERVER_CONFIG"},
+						Name:  "mode",
+						Usage: "merge: add new records and keep the others, replace: make local records equal to the file",
+						Value: svc.ImportMerge,
+					},
+					&cli.BoolFlag{
+						Name:  "dry-run",
+						Usage: "print what would change without writing",
 					},
 				},
 			},
@@ -57,6 +98,98 @@ func main() {
 	}
 }
 
+func configFlag() cli.Flag {
+	return &cli.StringFlag{
+		Name:     "config",
+		Usage:    "config file",
+		Required: true,
+		Aliases:  []string{"c"},
+		EnvVars:  []string{"DNS_SERVER_CONFIG"},
+	}
+}
+
+// lockedBackend 关闭后端时释放rw_path的锁
+type lockedBackend struct {
+	svc.Backend
+	lock *os.File
+}
+
+func (b *lockedBackend) Close() error {
+	defer b.lock.Close()
+	return b.Backend.Close()
+}
+
+// loadConfig 读取配置文件，export/import的日志输出到stderr
+func loadConfig(c *cli.Context) {
+	svc.ParseFile(c.String("config"))
+	lg := log.New()
+	lg.SetOutput(os.Stderr)
+	svc.SetLogger(map[string]*logrus.Logger{"log": lg})
+}
+
+// openBackend 按配置打开本地记录的存储后端，用于import。
+// 运行中的服务不会感知到import的修改，并且会用内存中的记录覆盖，服务运行时拒绝打开
+func openBackend(c *cli.Context) (svc.Backend, error) {
+	loadConfig(c)
+	lock, err := svc.LockRWDir(svc.GCONF.RWDirPath)
+	if err != nil {
+		return nil, fmt.Errorf("%v, stop the server or use /v1/batch instead", err)
+	}
+	b, err := svc.NewBackend(svc.GCONF.StoreBackend, svc.GCONF.RWDirPath)
+	if err != nil {
+		lock.Close()
+		return nil, err
+	}
+	b = &lockedBackend{Backend: b, lock: lock}
+	return b, b.Load()
+}
+
+// readBackend 只读地加载本地记录，不加锁也不修改存储，用于export和import --dry-run
+func readBackend(c *cli.Context) (svc.Backend, error) {
+	loadConfig(c)
+	return svc.ReadRecords(svc.GCONF.StoreBackend, svc.GCONF.RWDirPath)
+}
+
+func exportRecords(c *cli.Context) error {
+	b, err := readBackend(c)
+	if err != nil {
+		return err
+	}
+	out := os.Stdout
+	if file := c.String("output"); file != "" {
+		if out, err = os.Create(file); err != nil {
+			return err
+		}
+		defer out.Close()
+	}
+	return svc.ExportRecords(b, out, svc.ParseFormat(c.String("output"), c.String("format")))
+}
+
+func importRecords(c *cli.Context) error {
+	file := c.Args().First()
+	if file == "" {
+		return fmt.Errorf("missing file to import")
+	}
+	f, err := os.Open(file)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	open := openBackend
+	if c.Bool("dry-run") {
+		open = readBackend
+	}
+	b, err := open(c)
+	if err != nil {
+		return err
+	}
+	err = svc.ImportRecords(b, f, file, svc.ParseFormat(file, c.String("format")), c.String("mode"), c.Bool("dry-run"), os.Stdout)
+	if cerr := b.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
+
 func serve(c *cli.Context) error {
 	flag.Parse()
 	svc.ParseFile(c.String("config"))
@@ -98,6 +231,12 @@ func serve(c *cli.Context) error {
 		lg.Errorf("create rwdirpath: %v error: %v", GConf, err)
 		return err
 	}
+	lock, err := svc.LockRWDir(GConf.RWDirPath)
+	if err != nil {
+		lg.Errorf("lock rwdirpath error: %v", err)
+		return err
+	}
+	defer lock.Close()
 	lg.Info("start dns server")
 	svc.SetLogger(logMap)
 	api.SetClient(&api.Client{
@@ -110,11 +249,36 @@ func serve(c *cli.Context) error {
 		RemoteHost: GConf.RemoteHost,
 		MaxTry:     3,
 	})
-	dns := svc.NewDNService(GConf.RWDirPath, []net.UDPAddr{{IP: net.ParseIP(GConf.ForwardIP), Port: GConf.ForwardPort}},
+	forwarders, err := svc.ParseUDPAddrs(GConf.Forwarders, 53)
+	if err != nil {
+		lg.Errorf("parse forwarders error: %v", err)
+		return err
+	}
+	if len(forwarders) == 0 { //兼容只配置了forward_ip/forward_port的旧配置
+		forwarders = []net.UDPAddr{{IP: net.ParseIP(GConf.ForwardIP), Port: GConf.ForwardPort}}
+	}
+	backend, err := svc.NewBackend(GConf.StoreBackend, GConf.RWDirPath)
+	if err != nil {
+		lg.Errorf("create store backend error: %v", err)
+		return err
+	}
+	dns := svc.NewDNService(GConf.RWDirPath, forwarders,
 		svc.WithPTRHookAction(custom.PTRHookAction),
 		svc.WithAAAAHookAction(custom.AAAAHookAction),
 		svc.WithAHookAction(custom.AHookAction),
 		svc.WithSaveWList(GConf.WhiteList),
+		svc.WithBlackLists(GConf.BlackList),
+		svc.WithListRefresh(GConf.ListRefresh),
+		svc.WithUDPSize(GConf.EDNSUDPSize),
+		svc.WithForwardTimeout(GConf.ForwardTimeout),
+		svc.WithForwardStrategy(GConf.ForwardPolicy),
+		svc.WithHealthCheck(GConf.HealthInterval),
+		svc.WithForwardRules(GConf.ForwardRules, GConf.ForwardDir),
+		svc.WithZoneDir(GConf.ZoneDir),
+		svc.WithCacheTTL(uint32(GConf.CacheMinTTL), uint32(GConf.CacheMaxTTL)),
+		svc.WithCacheLimit(GConf.CacheEntries, GConf.CacheBytes, GConf.CachePolicy),
+		svc.WithCacheSweep(GConf.CacheSweep),
+		svc.WithBackend(backend),
 	)
 	rest := svc.RestService{Dn: dns}
 	//通过restfulapi的调用支持添加，读取，更新，删除功能
@@ -133,14 +297,60 @@ func serve(c *cli.Context) error {
 		}
 	}
 
-	withAuth := func(h http.HandlerFunc) http.HandlerFunc {
-		var _ = "intercept"
-		return func(w http.ResponseWriter, r *http.Request) {
-			h(w, r)
-		}
+	auth, err := svc.NewAuthenticator(GConf.APITokens, GConf.APIUsers, GConf.APIClientCerts)
+	if err != nil {
+		lg.Errorf("parse api credentials error: %v", err)
+		return err
+	}
+	if len(GConf.APIClientCerts) > 0 && (GConf.APITLSCert == "" || GConf.APIClientCA == "") { //不验证客户端证书时api_client_cert永远不会生效
+		err = fmt.Errorf("api_client_cert requires api_tls_cert and api_client_ca")
+		lg.Error(err)
+		return err
 	}
+	if !auth.Enabled() {
+		lg.Warn("no api_token, api_user or api_client_cert configured, the REST API is not authenticated")
+	}
+	withAuth := auth.Wrap
 
 	http.Handle("/dns", withAuth(dnsHandler()))
-	log.Fatal(http.ListenAndServe(fmt.Sprintf(":%v", GConf.ServerPort), nil))
+	http.Handle("/dns/stats", withAuth(rest.Stats))
+	http.Handle("/v1/", withAuth(rest.V1))
+	addr := GConf.APIListen
+	if addr == "" {
+		addr = fmt.Sprintf(":%v", GConf.ServerPort)
+	}
+	srv := &http.Server{Addr: addr}
+	errc := make(chan error, 1)
+	if GConf.APITLSCert == "" {
+		go func() { errc <- srv.ListenAndServe() }()
+	} else {
+		tlsConf, err := svc.APITLSConfig(GConf.APITLSCert, GConf.APITLSKey, GConf.APITLSMin, GConf.APIClientCA)
+		if err != nil {
+			lg.Errorf("load api tls config error: %v", err)
+			return err
+		}
+		srv.TLSConfig = tlsConf
+		go func() { errc <- srv.ListenAndServeTLS("", "") }()
+	}
+
+	//收到SIGINT/SIGTERM时等待进行中的REST请求完成，保存本地记录后退出
+	sig := make(chan os.Signal, 1)
+	signal.Notify(sig, syscall.SIGINT, syscall.SIGTERM)
+	select {
+	case err = <-errc:
+	case s := <-sig:
+		lg.Infof("receive %v, shutting down", s)
+		ctx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+		if err := srv.Shutdown(ctx); err != nil {
+			lg.Errorf("shutdown rest api error: %v", err)
+		}
+		cancel()
+	}
+	if cerr := backend.Close(); cerr != nil {
+		lg.Errorf("close store backend error: %v", cerr)
+	}
+	if err != nil {
+		log.Fatal(err)
+	}
 	return nil
 }
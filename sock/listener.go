@@ -116,7 +116,7 @@ func determineUDPProto(proto_in string, addr *net.UDPAddr) (proto_out string, er
 	case "udp", "udp4", "udp6":
 		return proto_in, nil
 	}
-	return "", fmt.Errorf("not support this protprype", proto_in)
+	return "", fmt.Errorf("not support this protprype: %v", proto_in)
 }
 
 func InitListener(address string) (l *listener, err error) {
@@ -0,0 +1,185 @@
+package svc
+
+import (
+	"context"
+	"crypto/subtle"
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+// principal 通过认证的调用方及其权限
+type principal struct {
+	name  string
+	write bool     //可以修改所有记录
+	zones []string //可以修改的区，write为true时忽略
+}
+
+type principalKey struct{}
+
+// Authenticator REST接口的认证和授权。支持三种凭据：
+//
+//	api_token       <token> <scopes>            Authorization: Bearer <token>
+//	api_user        <user> <password> <scopes>  HTTP basic认证
+//	api_client_cert <CN> <scopes>               HTTPS下经过api_client_ca验证的客户端证书
+//
+// scopes以逗号分隔：read只读，write可以修改所有记录，write:<zone>只能修改区内的记录，
+// write和write:<zone>都包含read。没有配置任何凭据时不做认证
+type Authenticator struct {
+	tokens map[string]*principal
+	users  map[string]*principal
+	passwd map[string]string
+	certs  map[string]*principal
+}
+
+// NewAuthenticator 根据配置中的api_token，api_user和api_client_cert创建Authenticator
+func NewAuthenticator(tokens, users, certs []string) (*Authenticator, error) {
+	a := &Authenticator{
+		tokens: make(map[string]*principal),
+		users:  make(map[string]*principal),
+		passwd: make(map[string]string),
+		certs:  make(map[string]*principal),
+	}
+	for i, line := range tokens {
+		f := strings.Fields(line)
+		if len(f) != 2 {
+			return nil, fmt.Errorf("api_token #%v: want <token> <scopes>", i+1)
+		}
+		p, err := parseScopes(fmt.Sprintf("token#%v", i+1), f[1])
+		if err != nil {
+			return nil, err
+		}
+		a.tokens[f[0]] = p
+	}
+	for i, line := range users {
+		f := strings.Fields(line)
+		if len(f) != 3 {
+			return nil, fmt.Errorf("api_user #%v: want <user> <password> <scopes>", i+1)
+		}
+		p, err := parseScopes("user "+f[0], f[2])
+		if err != nil {
+			return nil, err
+		}
+		a.users[f[0]], a.passwd[f[0]] = p, f[1]
+	}
+	for _, line := range certs {
+		f := strings.Fields(line)
+		if len(f) != 2 {
+			return nil, fmt.Errorf("api_client_cert %q: want <CN> <scopes>", line)
+		}
+		p, err := parseScopes("cert "+f[0], f[1])
+		if err != nil {
+			return nil, err
+		}
+		a.certs[f[0]] = p
+	}
+	return a, nil
+}
+
+func parseScopes(name, scopes string) (*principal, error) {
+	p := &principal{name: name}
+	for _, s := range strings.Split(scopes, ",") {
+		switch {
+		case s == "read":
+		case s == "write":
+			p.write = true
+		case strings.HasPrefix(s, "write:") && len(s) > len("write:"):
+			p.zones = append(p.zones, canonicalName(s[len("write:"):]))
+		default:
+			return nil, fmt.Errorf("%v: unknown scope %q", name, s)
+		}
+	}
+	return p, nil
+}
+
+// Enabled 是否配置了凭据
+func (a *Authenticator) Enabled() bool {
+	return a != nil && len(a.tokens)+len(a.users)+len(a.certs) > 0
+}
+
+// authenticate 返回请求对应的principal，凭据无效时返回错误
+func (a *Authenticator) authenticate(r *http.Request) (*principal, error) {
+	if h := r.Header.Get("Authorization"); strings.HasPrefix(h, "Bearer ") {
+		token := strings.TrimSpace(h[len("Bearer "):])
+		var found *principal
+		for t, p := range a.tokens { //逐个比较，避免通过耗时猜测token
+			if subtle.ConstantTimeCompare([]byte(t), []byte(token)) == 1 {
+				found = p
+			}
+		}
+		if found == nil {
+			return nil, fmt.Errorf("invalid bearer token")
+		}
+		return found, nil
+	}
+	if user, pass, ok := r.BasicAuth(); ok {
+		p, known := a.users[user]
+		if !known || subtle.ConstantTimeCompare([]byte(a.passwd[user]), []byte(pass)) != 1 {
+			return nil, fmt.Errorf("invalid password for user %q", user)
+		}
+		return p, nil
+	}
+	if r.TLS != nil && len(r.TLS.VerifiedChains) > 0 {
+		cn := r.TLS.VerifiedChains[0][0].Subject.CommonName
+		if p, ok := a.certs[cn]; ok {
+			return p, nil
+		}
+		return nil, fmt.Errorf("client certificate %q is not allowed", cn)
+	}
+	return nil, fmt.Errorf("missing credentials")
+}
+
+// Wrap 认证请求并检查读写权限，修改具体区的权限由handler通过canWrite检查
+func (a *Authenticator) Wrap(h http.HandlerFunc) http.HandlerFunc {
+	if !a.Enabled() {
+		return h
+	}
+	return func(w http.ResponseWriter, r *http.Request) {
+		p, err := a.authenticate(r)
+		if err != nil {
+			w.Header().Set("WWW-Authenticate", `Bearer realm="dns", Basic realm="dns"`)
+			deny(w, r, http.StatusUnauthorized, err.Error())
+			return
+		}
+		readOnly := r.Method == http.MethodGet || r.Method == http.MethodHead
+		if !readOnly && !p.write && len(p.zones) == 0 {
+			deny(w, r, http.StatusForbidden, p.name+" is read-only")
+			return
+		}
+		h(w, r.WithContext(context.WithValue(r.Context(), principalKey{}, p)))
+	}
+}
+
+// canWrite 检查调用方是否可以修改name的记录，不允许时返回403并记录日志
+func canWrite(w http.ResponseWriter, r *http.Request, name string) bool {
+	if err := writeAllowed(r, name); err != nil {
+		deny(w, r, http.StatusForbidden, err.Error())
+		return false
+	}
+	return true
+}
+
+// writeAllowed 检查调用方是否可以修改name的记录，不写应答也不记录日志
+func writeAllowed(r *http.Request, name string) error {
+	p, ok := r.Context().Value(principalKey{}).(*principal)
+	if !ok || p.write {
+		return nil
+	}
+	name = canonicalName(name)
+	for _, z := range p.zones {
+		if inZone(name, z) {
+			return nil
+		}
+	}
+	return fmt.Errorf("%v may not modify %v", p.name, name)
+}
+
+// deny 拒绝请求并记录到主日志
+func deny(w http.ResponseWriter, r *http.Request, status int, reason string) {
+	logDenied(r, reason)
+	http.Error(w, http.StatusText(status), status)
+}
+
+func logDenied(r *http.Request, reason string) {
+	log.Warnf("api access denied: %v %v from %v: %v", r.Method, r.URL.Path, r.RemoteAddr, reason)
+}
@@ -0,0 +1,96 @@
+package svc
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+// Backend 本地记录的存储后端，key为ntString(名称, 类型)，value为该key下的RRset。
+// 实现需要并发安全，修改操作返回后由实现自行负责持久化
+type Backend interface {
+	// Get 返回key对应的RRset，不存在或为空时ok为false
+	Get(key string) ([]dnsmessage.Resource, bool)
+	// Set old为nil时把r追加到RRset，否则用r替换与old相同的记录，返回是否有修改
+	Set(key string, r dnsmessage.Resource, old *dnsmessage.Resource) bool
+	// Override 用rs整体替换key对应的RRset，rs为空时删除key
+	Override(key string, rs []dnsmessage.Resource)
+	// Remove r为nil时删除整个RRset，否则只删除与r相同的记录，返回是否有删除
+	Remove(key string, r *dnsmessage.Resource) bool
+	// Batch 在写锁内调用fn，fn通过tx读取和修改记录。fn返回错误时不做任何修改，
+	// 否则所有修改同时生效，并且只持久化一次
+	Batch(fn func(tx *Tx) error) error
+	// Iterate 遍历所有RRset，fn返回false时停止，fn中不能修改Backend
+	Iterate(fn func(key string, rs []dnsmessage.Resource) bool)
+	// Snapshot 返回所有RRset的副本
+	Snapshot() map[string][]dnsmessage.Resource
+	// Load 从持久化存储中加载记录，在NewDNService中调用一次
+	Load() error
+	// Close 保存未写入的变更并释放资源
+	Close() error
+}
+
+// migrator 从旧版本store文件加载时，混在其中的上游应答不作为本地记录，由NewDNService取出放入缓存
+type migrator interface {
+	takeMigrated() map[string]entry
+}
+
+// 配置项store_backend支持的后端
+const (
+	BackendGob     = "gob"     //全量gob快照，默认
+	BackendJournal = "journal" //追加写的变更日志
+	BackendMemory  = "memory"  //只保存在内存中，用于测试
+)
+
+// NewBackend 根据名称创建rwDirPath下的存储后端
+func NewBackend(name, rwDirPath string) (Backend, error) {
+	switch name {
+	case "", BackendGob:
+		return NewGobBackend(rwDirPath), nil
+	case BackendJournal:
+		return NewJournalBackend(rwDirPath), nil
+	case BackendMemory:
+		return NewMemoryBackend(), nil
+	}
+	return nil, fmt.Errorf("unknown store backend %q", name)
+}
+
+// ReadRecords 只读地加载rwDirPath下name后端保存的记录，返回内存中的副本。
+// 不加锁，不截断或压缩日志，服务运行时也可以使用，用于export和import --dry-run
+func ReadRecords(name, rwDirPath string) (Backend, error) {
+	s := newStore()
+	switch name {
+	case "", BackendGob:
+	case BackendJournal:
+		j := &journalStore{store: s}
+		path := filepath.Join(rwDirPath, journalName)
+		f, err := os.Open(path)
+		if err != nil && !os.IsNotExist(err) {
+			return nil, err
+		}
+		if err == nil {
+			good := j.replay(f, path)
+			f.Close()
+			if good > 0 {
+				return s, nil
+			}
+		}
+	case BackendMemory:
+		return s, nil
+	default:
+		return nil, fmt.Errorf("unknown store backend %q", name)
+	}
+	//gob后端以及还没有日志的journal后端从store文件读取
+	records, _, _ := readStoreRecords(rwDirPath)
+	for key, rs := range records {
+		s.data[key] = rs
+	}
+	return s, nil
+}
+
+// NewMemoryBackend 返回只保存在内存中的后端
+func NewMemoryBackend() Backend {
+	return newStore()
+}
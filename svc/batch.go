@@ -0,0 +1,122 @@
+package svc
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+const maxBatchOps = 10000
+
+// 批量操作的类型，字段与Create，Update和Delete的请求相同
+const (
+	batchAdd    = "add"
+	batchUpdate = "update"
+	batchDelete = "delete"
+)
+
+var errBatchAborted = errors.New("batch aborted")
+
+type batchOp struct {
+	Op string
+	request
+}
+
+// batchResult 一个操作的结果，Status为单独执行该操作时的HTTP状态码
+type batchResult struct {
+	Op     string
+	Host   string
+	Type   string
+	Status int
+	Error  string `json:",omitempty"`
+}
+
+type batchResponse struct {
+	Applied bool //为false时所有操作都没有生效
+	Results []batchResult
+}
+
+// batch 处理POST /v1/batch：按顺序执行一组add，update，delete操作，全部成功时一起生效并只持久化一次，
+// 任一操作失败时全部不生效，应答的状态码为第一个失败操作的状态码
+func (s *RestService) batch(w http.ResponseWriter, r *http.Request) {
+	var ops []batchOp
+	if err := json.NewDecoder(r.Body).Decode(&ops); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if len(ops) == 0 || len(ops) > maxBatchOps {
+		http.Error(w, fmt.Sprintf("batch must contain 1 to %v operations", maxBatchOps), http.StatusBadRequest)
+		return
+	}
+
+	resp := batchResponse{Results: make([]batchResult, len(ops))}
+	status := http.StatusOK
+	err := s.Dn.book.Batch(func(tx *Tx) error {
+		for i, op := range ops {
+			code, err := applyBatchOp(tx, r, op)
+			resp.Results[i] = batchResult{Op: strings.ToLower(op.Op), Host: op.Host, Type: op.Type, Status: code}
+			if err != nil {
+				resp.Results[i].Error = err.Error()
+				if status == http.StatusOK {
+					status = code
+				}
+			}
+		}
+		if status != http.StatusOK {
+			return errBatchAborted
+		}
+		return nil
+	})
+	resp.Applied = err == nil
+	writeJSON(w, r, status, resp)
+}
+
+func applyBatchOp(tx *Tx, r *http.Request, op batchOp) (int, error) {
+	kind := strings.ToLower(op.Op)
+	if kind != batchAdd && kind != batchUpdate && kind != batchDelete {
+		return http.StatusBadRequest, fmt.Errorf("unknown op %q", op.Op)
+	}
+	if err := writeAllowed(r, op.Host); err != nil {
+		logDenied(r, err.Error())
+		return http.StatusForbidden, err
+	}
+	if kind == batchDelete {
+		key, target, err := deleteTarget(op.request)
+		if err != nil {
+			return http.StatusBadRequest, err
+		}
+		if !tx.Remove(key, target) {
+			return http.StatusNotFound, fmt.Errorf("record not found")
+		}
+		return http.StatusOK, nil
+	}
+
+	res, err := toResource(op.request)
+	if err != nil {
+		return http.StatusBadRequest, err
+	}
+	key := ntString(res.Header.Name, res.Header.Type)
+	if kind == batchAdd {
+		if rs, _ := tx.Get(key); indexResource(rs, res) >= 0 {
+			return http.StatusConflict, fmt.Errorf("record already exists")
+		}
+		if err := validateRecord(tx, res, nil); err != nil {
+			return validationStatus(err), err
+		}
+		tx.Set(key, res, nil)
+		return http.StatusCreated, nil
+	}
+	old, err := oldResource(op.request)
+	if err != nil {
+		return http.StatusBadRequest, err
+	}
+	if err := validateRecord(tx, res, &old); err != nil {
+		return validationStatus(err), err
+	}
+	if !tx.Set(key, res, &old) {
+		return http.StatusNotFound, fmt.Errorf("record not found")
+	}
+	return http.StatusOK, nil
+}
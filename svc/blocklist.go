@@ -0,0 +1,130 @@
+package svc
+
+import (
+	"dns/match"
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+// blockTTL 拦截时合成的A/AAAA记录的TTL
+const blockTTL = 60
+
+// 拦截时的应答方式
+const (
+	blockNXDomain = "nxdomain" //默认
+	blockRefused  = "refused"
+	blockNull     = "null" //A应答0.0.0.0，AAAA应答::
+)
+
+// blockList 一个黑名单，规则的写法见match.Matcher
+type blockList struct {
+	path     string
+	format   string //为空时按文件自动判断
+	action   string
+	sinkhole net.IP //action为空时应答的地址
+	rules    *match.Matcher
+}
+
+type blockStore struct {
+	sync.RWMutex
+	lists []*blockList
+}
+
+// parseBlockList 解析配置项black_list："文件或目录 [nxdomain|refused|null|sinkhole地址] [format=格式]"
+func parseBlockList(line string) (*blockList, error) {
+	path, format, fields, err := parseListSpec(line)
+	if err != nil || len(fields) > 1 {
+		return nil, fmt.Errorf("black_list %q: want <path> [nxdomain|refused|null|<ip>] [format=<format>]", line)
+	}
+	l := &blockList{path: path, format: format, action: blockNXDomain}
+	if len(fields) == 1 {
+		switch a := strings.ToLower(fields[0]); a {
+		case blockNXDomain, blockRefused, blockNull:
+			l.action = a
+		default:
+			if l.sinkhole = net.ParseIP(fields[0]); l.sinkhole == nil {
+				return nil, fmt.Errorf("black_list %q: unknown response %q", line, fields[0])
+			}
+			l.action = ""
+		}
+	}
+	return l, nil
+}
+
+// load 加载所有黑名单并整体替换，URL由lf获取，加载失败的名单记录日志后跳过
+func (bs *blockStore) load(lines []string, lf *listFetcher) {
+	var lists []*blockList
+	for _, line := range lines {
+		l, err := parseBlockList(line)
+		var path string
+		if err == nil {
+			path, err = lf.local(l.path, l.format)
+		}
+		if err == nil {
+			l.rules, err = loadRules(path, l.format, false)
+		}
+		if err != nil {
+			log.Errorf("load black list error: %v", err)
+			continue
+		}
+		log.Infof("load black list %v, %v rules", l.path, l.rules.Len())
+		lists = append(lists, l)
+	}
+	bs.Lock()
+	bs.lists = lists
+	bs.Unlock()
+}
+
+// match 按配置顺序返回第一个拦截name的名单和匹配的规则
+func (bs *blockStore) match(name string) (*blockList, string) {
+	bs.RLock()
+	defer bs.RUnlock()
+	for _, l := range bs.lists {
+		if rule, ok := l.rules.Match(name); ok {
+			return l, rule
+		}
+	}
+	return nil, ""
+}
+
+// answer 构造拦截的应答：NXDOMAIN，REFUSED，或者在A/AAAA查询中返回0.0.0.0/::或sinkhole地址，
+// 地址族与查询类型不符时返回没有记录的NOERROR
+func (l *blockList) answer(q dnsmessage.Question, m *dnsmessage.Message) {
+	switch l.action {
+	case blockNXDomain:
+		m.RCode = dnsmessage.RCodeNameError
+		return
+	case blockRefused:
+		m.RCode = dnsmessage.RCodeRefused
+		return
+	}
+	ip := l.sinkhole
+	if l.action == blockNull {
+		ip = net.IPv4zero
+		if q.Type == dnsmessage.TypeAAAA {
+			ip = net.IPv6zero
+		}
+	}
+	h := dnsmessage.ResourceHeader{Name: q.Name, Type: q.Type, Class: dnsmessage.ClassINET, TTL: blockTTL}
+	if ip4 := ip.To4(); ip4 != nil && q.Type == dnsmessage.TypeA {
+		var a [4]byte
+		copy(a[:], ip4)
+		m.Answers = []dnsmessage.Resource{{Header: h, Body: &dnsmessage.AResource{A: a}}}
+	} else if ip.To4() == nil && q.Type == dnsmessage.TypeAAAA {
+		var aaaa [16]byte
+		copy(aaaa[:], ip)
+		m.Answers = []dnsmessage.Resource{{Header: h, Body: &dnsmessage.AAAAResource{AAAA: aaaa}}}
+	}
+}
+
+// response 返回名单的应答方式，用于日志
+func (l *blockList) response() string {
+	if l.action == "" {
+		return l.sinkhole.String()
+	}
+	return l.action
+}
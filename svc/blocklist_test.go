@@ -0,0 +1,65 @@
+package svc
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+func TestBlockStore(t *testing.T) {
+	dir, err := ioutil.TempDir("", "black")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	ads, track := filepath.Join(dir, "ads"), filepath.Join(dir, "track")
+	ioutil.WriteFile(ads, []byte("# ads\n^ads\\.example\\.com$\n(\n"), 0666)
+	ioutil.WriteFile(track, []byte("tracker\\.\n"), 0666)
+
+	if _, err := parseBlockList(ads + " drop"); err == nil {
+		t.Error("unknown response accepted")
+	}
+	var bs blockStore
+	bs.load([]string{ads + " refused", track + " 2001:db8::1", filepath.Join(dir, "missing")}, nil)
+	if len(bs.lists) != 2 || bs.lists[0].rules.Len() != 1 {
+		t.Fatalf("unexpected lists %+v", bs.lists)
+	}
+
+	cases := []struct {
+		name  string
+		qtype dnsmessage.Type
+		rcode dnsmessage.RCode
+		ans   int
+	}{
+		{"ADS.example.com.", dnsmessage.TypeA, dnsmessage.RCodeRefused, 0},
+		{"x.tracker.net.", dnsmessage.TypeAAAA, dnsmessage.RCodeSuccess, 1},
+		{"x.tracker.net.", dnsmessage.TypeA, dnsmessage.RCodeSuccess, 0},
+	}
+	for _, c := range cases {
+		l, rule := bs.match(c.name)
+		if l == nil {
+			t.Errorf("%v is not blocked", c.name)
+			continue
+		}
+		q := dnsmessage.Question{Name: dnsmessage.MustNewName(c.name), Type: c.qtype, Class: dnsmessage.ClassINET}
+		var m dnsmessage.Message
+		l.answer(q, &m)
+		if m.RCode != c.rcode || len(m.Answers) != c.ans {
+			t.Errorf("%v %v by %q: rcode %v, %v answers", c.name, c.qtype, rule, m.RCode, len(m.Answers))
+		}
+	}
+	if l, _ := bs.match("www.example.com."); l != nil {
+		t.Error("www.example.com. is blocked")
+	}
+
+	null, _ := parseBlockList(ads + " null")
+	q := dnsmessage.Question{Name: dnsmessage.MustNewName("ads.example.com."), Type: dnsmessage.TypeAAAA, Class: dnsmessage.ClassINET}
+	var m dnsmessage.Message
+	null.answer(q, &m)
+	if len(m.Answers) != 1 || m.Answers[0].Body.(*dnsmessage.AAAAResource).AAAA != [16]byte{} {
+		t.Errorf("null response: %+v", m.Answers)
+	}
+}
@@ -0,0 +1,300 @@
+package svc
+
+import (
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+const defaultSweepInterval = time.Minute
+
+// cache 保存从上游学习到的应答，按TTL过期，超出容量时淘汰，只保存在内存中。
+// 通过REST接口添加的记录保存在store中，优先于cache
+type cache struct {
+	sync.RWMutex
+	data       map[string]entry
+	maxEntries int   //最大条目数，0为不限制
+	maxBytes   int64 //最大占用内存(估算值)，0为不限制
+	policy     evictor
+	bytes      int64
+	stats      cacheCounters
+}
+
+// cacheCounters 缓存计数，通过REST接口查询
+type cacheCounters struct {
+	Hits      uint64
+	Misses    uint64
+	Evictions uint64 //因超出容量被淘汰的条目数
+	Expired   uint64 //因TTL到期被删除的条目数
+}
+
+// CacheStats 缓存的容量和计数
+type CacheStats struct {
+	cacheCounters
+	Entries    int
+	Bytes      int64
+	MaxEntries int
+	MaxBytes   int64
+	Policy     string
+}
+
+func newCache(maxEntries int, maxBytes int64, policy evictor) *cache {
+	return &cache{
+		data:       make(map[string]entry),
+		maxEntries: maxEntries,
+		maxBytes:   maxBytes,
+		policy:     policy,
+	}
+}
+
+// get 返回未过期的RRset，记录的TTL减去已缓存的时间，过期的直接删除
+func (c *cache) get(key string) (entry, bool) {
+	c.RLock()
+	e, ok := c.data[key]
+	c.RUnlock()
+	if !ok {
+		atomic.AddUint64(&c.stats.Misses, 1)
+		return e, false
+	}
+	now := time.Now().Unix()
+	if e.expired(now) {
+		c.removeExpired(key, now)
+		atomic.AddUint64(&c.stats.Misses, 1)
+		return entry{}, false
+	}
+	atomic.AddUint64(&c.stats.Hits, 1)
+	c.policy.touch(key)
+	elapsed := uint32(now - e.Created)
+	e.Resources = decrementTTL(e.Resources, elapsed)
+	e.Authorities = decrementTTL(e.Authorities, elapsed)
+	return e, true
+}
+
+// peek 与get相同，但不计入命中统计也不影响淘汰顺序，用于REST查询
+func (c *cache) peek(key string) (entry, bool) {
+	c.RLock()
+	e, ok := c.data[key]
+	c.RUnlock()
+	now := time.Now().Unix()
+	if !ok || e.expired(now) {
+		return entry{}, false
+	}
+	elapsed := uint32(now - e.Created)
+	e.Resources = decrementTTL(e.Resources, elapsed)
+	e.Authorities = decrementTTL(e.Authorities, elapsed)
+	return e, true
+}
+
+// removeExpired 删除过期的RRset，期间被重新写入的不删除
+func (c *cache) removeExpired(key string, now int64) {
+	c.Lock()
+	if e, ok := c.data[key]; ok && e.expired(now) {
+		c.deleteLocked(key)
+		atomic.AddUint64(&c.stats.Expired, 1)
+	}
+	c.Unlock()
+}
+
+// sweep 删除所有已过期的条目
+func (c *cache) sweep() {
+	now := time.Now().Unix()
+	c.Lock()
+	for key, e := range c.data {
+		if e.expired(now) {
+			c.deleteLocked(key)
+			atomic.AddUint64(&c.stats.Expired, 1)
+		}
+	}
+	c.Unlock()
+}
+
+// sweepLoop 定期清理过期条目，避免不再被查询的条目一直占用内存
+func (c *cache) sweepLoop(interval time.Duration) {
+	if interval <= 0 {
+		interval = defaultSweepInterval
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for range ticker.C {
+		c.sweep()
+	}
+}
+
+// putLocked 写入条目并维护内存占用和淘汰策略，超出容量时淘汰其他条目，调用方需持有写锁
+func (c *cache) putLocked(key string, e entry) {
+	if old, ok := c.data[key]; ok {
+		c.bytes -= entrySize(key, old)
+	}
+	c.data[key] = e
+	c.bytes += entrySize(key, e)
+	c.policy.add(key)
+	for c.overLimit() {
+		victim, ok := c.policy.victim(key)
+		if !ok {
+			break
+		}
+		c.deleteLocked(victim)
+		atomic.AddUint64(&c.stats.Evictions, 1)
+	}
+}
+
+func (c *cache) deleteLocked(key string) {
+	if e, ok := c.data[key]; ok {
+		c.bytes -= entrySize(key, e)
+		delete(c.data, key)
+		c.policy.remove(key)
+	}
+}
+
+func (c *cache) overLimit() bool {
+	return (c.maxEntries > 0 && len(c.data) > c.maxEntries) || (c.maxBytes > 0 && c.bytes > c.maxBytes)
+}
+
+func (c *cache) statistics() CacheStats {
+	c.RLock()
+	defer c.RUnlock()
+	return CacheStats{
+		cacheCounters: cacheCounters{
+			Hits:      atomic.LoadUint64(&c.stats.Hits),
+			Misses:    atomic.LoadUint64(&c.stats.Misses),
+			Evictions: atomic.LoadUint64(&c.stats.Evictions),
+			Expired:   atomic.LoadUint64(&c.stats.Expired),
+		},
+		Entries:    len(c.data),
+		Bytes:      c.bytes,
+		MaxEntries: c.maxEntries,
+		MaxBytes:   c.maxBytes,
+		Policy:     c.policy.name(),
+	}
+}
+
+// entrySize 估算条目占用的内存
+func entrySize(key string, e entry) int64 {
+	n := len(key) + 64
+	for _, r := range e.Resources {
+		n += resourceSize(r)
+	}
+	for _, r := range e.Authorities {
+		n += resourceSize(r)
+	}
+	return int64(n)
+}
+
+func resourceSize(r dnsmessage.Resource) int {
+	n := int(r.Header.Name.Length) + 48
+	switch b := r.Body.(type) {
+	case *dnsmessage.AResource:
+		n += 4
+	case *dnsmessage.AAAAResource:
+		n += 16
+	case *dnsmessage.CNAMEResource:
+		n += int(b.CNAME.Length)
+	case *dnsmessage.NSResource:
+		n += int(b.NS.Length)
+	case *dnsmessage.PTRResource:
+		n += int(b.PTR.Length)
+	case *dnsmessage.MXResource:
+		n += 2 + int(b.MX.Length)
+	case *dnsmessage.SRVResource:
+		n += 6 + int(b.Target.Length)
+	case *dnsmessage.SOAResource:
+		n += 20 + int(b.NS.Length) + int(b.MBox.Length)
+	case *dnsmessage.TXTResource:
+		for _, t := range b.TXT {
+			n += 16 + len(t)
+		}
+	default:
+		n += 16
+	}
+	return n
+}
+
+// decrementTTL 返回TTL减去elapsed后的副本，不修改缓存中的记录
+func decrementTTL(rs []dnsmessage.Resource, elapsed uint32) []dnsmessage.Resource {
+	if len(rs) == 0 {
+		return rs
+	}
+	out := make([]dnsmessage.Resource, len(rs))
+	for i, r := range rs {
+		if r.Header.TTL > elapsed {
+			r.Header.TTL -= elapsed
+		} else {
+			r.Header.TTL = 0
+		}
+		out[i] = r
+	}
+	return out
+}
+
+// newCacheEntry 根据上游应答生成缓存项，TTL限制在[minTTL, maxTTL]之间。
+// NXDOMAIN和NODATA按authority段中SOA的TTL与MINIMUM的较小值缓存(RFC 2308)，
+// 没有SOA的否定应答以及其他错误应答不缓存
+func newCacheEntry(resp dnsmessage.Message, minTTL, maxTTL uint32) (entry, bool) {
+	e := entry{Created: time.Now().Unix(), RCode: resp.RCode}
+	switch {
+	case resp.RCode == dnsmessage.RCodeSuccess && len(resp.Answers) > 0:
+		e.Resources = clampTTL(resp.Answers, minTTL, maxTTL)
+		e.TTL = rrsetTTL(e.Resources)
+	case resp.RCode == dnsmessage.RCodeSuccess || resp.RCode == dnsmessage.RCodeNameError:
+		for _, r := range resp.Authorities {
+			soa, ok := r.Body.(*dnsmessage.SOAResource)
+			if !ok {
+				continue
+			}
+			if soa.MinTTL < r.Header.TTL {
+				r.Header.TTL = soa.MinTTL
+			}
+			e.Authorities = clampTTL([]dnsmessage.Resource{r}, minTTL, maxTTL)
+			e.TTL = e.Authorities[0].Header.TTL
+			break
+		}
+		if e.Authorities == nil {
+			return e, false
+		}
+	default:
+		return e, false
+	}
+	return e, e.TTL > 0
+}
+
+// clampTTL 返回TTL限制在[min, max]之间的副本
+func clampTTL(rs []dnsmessage.Resource, min, max uint32) []dnsmessage.Resource {
+	out := make([]dnsmessage.Resource, len(rs))
+	for i, r := range rs {
+		if r.Header.TTL < min {
+			r.Header.TTL = min
+		}
+		if max > 0 && r.Header.TTL > max {
+			r.Header.TTL = max
+		}
+		out[i] = r
+	}
+	return out
+}
+
+// put 写入上游应答，覆盖同一key已有的缓存
+func (c *cache) put(key string, e entry) {
+	c.Lock()
+	c.putLocked(key, e)
+	c.Unlock()
+}
+
+// clone 返回未过期的条目，记录的TTL为剩余的缓存时间
+func (c *cache) clone() map[string]entry {
+	now := time.Now().Unix()
+	cp := make(map[string]entry)
+	c.RLock()
+	for k, e := range c.data {
+		if e.expired(now) {
+			continue
+		}
+		elapsed := uint32(now - e.Created)
+		e.Resources = decrementTTL(e.Resources, elapsed)
+		e.Authorities = decrementTTL(e.Authorities, elapsed)
+		cp[k] = e
+	}
+	c.RUnlock()
+	return cp
+}
@@ -0,0 +1,124 @@
+package svc
+
+import (
+	"testing"
+	"time"
+
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+func TestCacheEvict(t *testing.T) {
+	for _, policy := range []string{"lru", "lfu"} {
+		ev, err := newEvictor(policy)
+		if err != nil {
+			t.Fatal(err)
+		}
+		c := newCache(2, 0, ev)
+		e := entry{TTL: 600, Created: time.Now().Unix()}
+		c.put("a", e)
+		c.put("b", e)
+		c.get("a")
+		c.get("b")
+		c.put("c", e) //新写入的key访问次数最少，不能淘汰它自己
+		if n := len(c.data); n != 2 {
+			t.Errorf("%v: got %v entries, want 2", policy, n)
+		}
+		if _, ok := c.data["c"]; !ok {
+			t.Errorf("%v: new key has been evicted", policy)
+		}
+		if got := c.statistics().Evictions; got != 1 {
+			t.Errorf("%v: got %v evictions, want 1", policy, got)
+		}
+	}
+}
+
+func soaAuthority(t *testing.T, ttl, minTTL uint32) dnsmessage.Resource {
+	r, err := toResource(request{Host: "example.", TTL: ttl, Type: "SOA", SOA: requestSOA{NS: "ns.example.", MBox: "admin.example.", MinTTL: minTTL}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return r
+}
+
+func TestNewCacheEntry(t *testing.T) {
+	a := func(ttl uint32) dnsmessage.Resource {
+		_, r := testRecord(t, "www.example.", "192.0.2.1")
+		r.Header.TTL = ttl
+		return r
+	}
+	for _, c := range []struct {
+		name     string
+		rcode    dnsmessage.RCode
+		answers  []dnsmessage.Resource
+		auth     []dnsmessage.Resource
+		min, max uint32
+		ok       bool
+		ttl      uint32
+	}{
+		{name: "answer uses smallest ttl", answers: []dnsmessage.Resource{a(300), a(100)}, ok: true, ttl: 100},
+		{name: "answer ttl raised to min", answers: []dnsmessage.Resource{a(5)}, min: 30, ok: true, ttl: 30},
+		{name: "answer ttl capped to max", answers: []dnsmessage.Resource{a(86400)}, max: 3600, ok: true, ttl: 3600},
+		{name: "nxdomain uses soa minimum", rcode: dnsmessage.RCodeNameError, auth: []dnsmessage.Resource{soaAuthority(t, 3600, 300)}, ok: true, ttl: 300},
+		{name: "nodata uses soa ttl", auth: []dnsmessage.Resource{soaAuthority(t, 60, 300)}, ok: true, ttl: 60},
+		{name: "negative ttl capped to max", rcode: dnsmessage.RCodeNameError, auth: []dnsmessage.Resource{soaAuthority(t, 3600, 3600)}, max: 600, ok: true, ttl: 600},
+		{name: "nxdomain without soa", rcode: dnsmessage.RCodeNameError},
+		{name: "servfail", rcode: dnsmessage.RCodeServerFailure, auth: []dnsmessage.Resource{soaAuthority(t, 60, 60)}},
+		{name: "zero ttl", answers: []dnsmessage.Resource{a(0)}},
+	} {
+		resp := dnsmessage.Message{Header: dnsmessage.Header{Response: true, RCode: c.rcode}, Answers: c.answers, Authorities: c.auth}
+		e, ok := newCacheEntry(resp, c.min, c.max)
+		if ok != c.ok || (ok && e.TTL != c.ttl) {
+			t.Errorf("%v: got ok=%v ttl=%v, want ok=%v ttl=%v", c.name, ok, e.TTL, c.ok, c.ttl)
+		}
+		if ok && len(e.Authorities) > 0 && e.Authorities[0].Header.TTL != c.ttl {
+			t.Errorf("%v: soa ttl %v, want %v", c.name, e.Authorities[0].Header.TTL, c.ttl)
+		}
+	}
+}
+
+func TestCacheDecrementTTL(t *testing.T) {
+	ev, _ := newEvictor("lru")
+	now := time.Now().Unix()
+	_, r1 := testRecord(t, "www.example.", "192.0.2.1")
+	_, r2 := testRecord(t, "www.example.", "192.0.2.2")
+	r1.Header.TTL, r2.Header.TTL = 300, 100
+	for _, c := range []struct {
+		name string
+		e    entry
+		ok   bool
+		ttls []uint32
+	}{
+		{"per record", entry{Resources: []dnsmessage.Resource{r1, r2}, TTL: 100, Created: now - 40}, true, []uint32{260, 60}},
+		{"negative", entry{RCode: dnsmessage.RCodeNameError, Authorities: []dnsmessage.Resource{soaAuthority(t, 300, 300)}, TTL: 300, Created: now - 100}, true, []uint32{200}},
+		{"expired rrset", entry{Resources: []dnsmessage.Resource{r1, r2}, TTL: 100, Created: now - 100}, false, nil},
+	} {
+		cache := newCache(0, 0, ev)
+		cache.put("k", c.e)
+		e, ok := cache.get("k")
+		if ok != c.ok {
+			t.Errorf("%v: got hit=%v, want %v", c.name, ok, c.ok)
+			continue
+		}
+		var ttls []uint32
+		for _, r := range append(e.Resources, e.Authorities...) {
+			ttls = append(ttls, r.Header.TTL)
+		}
+		if len(ttls) != len(c.ttls) {
+			t.Errorf("%v: got ttls %v, want %v", c.name, ttls, c.ttls)
+			continue
+		}
+		for i := range ttls {
+			if ttls[i] > c.ttls[i] || ttls[i]+1 < c.ttls[i] { //跨过秒边界时多减1
+				t.Errorf("%v: got ttls %v, want %v", c.name, ttls, c.ttls)
+				break
+			}
+		}
+		if !ok {
+			if _, ok := cache.data["k"]; ok {
+				t.Errorf("%v: expired entry is not removed", c.name)
+			}
+		} else if cached := cache.data["k"]; rrsetTTL(cached.Resources) != rrsetTTL(c.e.Resources) {
+			t.Errorf("%v: get modified the cached records", c.name)
+		}
+	}
+}
@@ -1,11 +1,11 @@
 package svc
 
 import (
-	"dns/match"
 	"errors"
 	"fmt"
 	"net"
 	"os"
+	"path/filepath"
 	"strings"
 
 	"github.com/sirupsen/logrus"
@@ -40,25 +40,33 @@ func SetLogger(logMap map[string]*logrus.Logger) {
 
 type DNSService struct {
 	conn       *net.UDPConn
-	book       store
-	memo       addrBag
-	forwarders []net.UDPAddr
+	book       Backend    //本地记录
+	cache      *cache     //上游应答的缓存
+	zones      zoneStore  //权威区，优先于缓存和转发
+	blocks     blockStore //黑名单，在本地记录之后，缓存和转发之前检查
+	memo       *pendingTable
+	forwarders *upstreamPool //默认上游
+	rules      forwardRules  //条件转发规则，优先于默认上游
 	opt        *Options
 }
 
 type Packet struct {
 	addr    net.UDPAddr
 	message dnsmessage.Message
+	tcp     *tcpConn //通过TCP收到的查询，应答从该连接写回；UDP查询为nil
 }
 
 const (
 	udpPort   int = 53
-	packetLen int = 512
+	packetLen int = 512 //未使用EDNS(0)时UDP报文的最大长度
 )
 
 var (
 	errTypeNotSupport = errors.New("type not support")
 	errIPInvalid      = errors.New("invalid IP address")
+	errIPFamily       = errors.New("A record needs an IPv4 address and AAAA an IPv6 address")
+	errTXTEmpty       = errors.New("TXT record needs at least one string")
+	errTXTTooLong     = errors.New("TXT string longer than 255 bytes")
 )
 
 func (s *DNSService) Listen() {
@@ -68,29 +76,30 @@ func (s *DNSService) Listen() {
 		log.Fatal(err)
 	}
 	defer s.conn.Close()
+	go s.listenTCP()
 
 	for {
-		buf := make([]byte, packetLen)
-		_, addr, err := s.conn.ReadFromUDP(buf)
+		buf := make([]byte, s.opt.udpSize)
+		n, addr, err := s.conn.ReadFromUDP(buf)
 		if err != nil {
 			log.Error(err)
 			continue
 		}
 		var m dnsmessage.Message
-		err = m.Unpack(buf)
+		err = m.Unpack(buf[:n])
 		if err != nil {
 			log.Error(err)
 			continue
 		}
-		if len(m.Questions) == 0 {
+		if len(m.Questions) == 0 || m.Response { //上游应答只从转发用的socket接收，监听端口上的应答一律丢弃
 			continue
 		}
-		go s.Query(Packet{*addr, m})
+		go s.Query(Packet{addr: *addr, message: m})
 	}
 }
 func (s *DNSService) filterDomin(domain string) bool {
-	// return !match.DomainMatch(domain, s.opt.blacklistMap) || match.DomainMatch(domain, s.opt.whitelistMap)
-	return match.DomainMatch(domain, s.opt.whitelistMap)
+	_, ok := s.opt.whitelist.match(domain)
+	return ok
 }
 
 func printByteSlice(b []byte) string {
@@ -180,102 +189,211 @@ func (s *DNSService) checkQuestion(searchType string, question dnsmessage.Questi
 	}
 }
 func (s *DNSService) Query(p Packet) {
-	// 该response是从顶级域名返回结果发送给client
-	if p.message.Header.Response {
-		pKey := pString(p)
-		if addrs, ok := s.memo.get(pKey); ok {
-			go s.checkQuestion("forward", p.message.Questions[0], p.message.Answers)
-			for _, addr := range addrs {
-				go sendPacket(s.conn, p.message, addr)
-			}
-			s.memo.remove(pKey)
-			q := p.message.Questions[0]
-			go s.saveBulk(qString(q), p.message.Answers)
-		}
+	q := p.message.Questions[0]
+	if z := s.zones.find(q.Name.String()); z != nil && (q.Class == dnsmessage.ClassINET || q.Class == dnsmessage.ClassANY) {
+		m := responseTo(p.message)
+		m.RecursionAvailable = false
+		z.answer(q, &m)
+		go s.reply(p, m)
 		return
 	}
-
-	q := p.message.Questions[0]
-	val, ok := s.book.get(qString(q))
-	if ok {
-		p.message.Response = true
-		p.message.Answers = append(p.message.Answers, val...) //如果本地有缓存，则直接发送至client
-		go s.checkQuestion("cache", q, p.message.Answers)
-		go sendPacket(s.conn, p.message, p.addr)
+	if rs, ok := s.book.Get(qString(q)); ok { //本地记录优先于缓存和上游
+		m := responseTo(p.message)
+		m.Answers = rs
+		go s.checkQuestion("local", q, m.Answers)
+		go s.reply(p, m)
+	} else if l, rule := s.blocks.match(q.Name.String()); l != nil {
+		m := responseTo(p.message)
+		l.answer(q, &m)
+		blog.Infof("block %v %v from %v, list=%v rule=%q response=%v", q.Name.String(), strings.TrimPrefix(q.Type.String(), "Type"), p.addr.String(), l.path, rule, l.response())
+		go s.reply(p, m)
+	} else if e, ok := s.cache.get(qString(q)); ok { //如果本地有缓存，则直接发送至client，TTL为剩余的缓存时间
+		m := responseTo(p.message)
+		m.RCode = e.RCode
+		m.Answers = e.Resources
+		m.Authorities = e.Authorities
+		go s.checkQuestion("cache", q, m.Answers)
+		go s.reply(p, m)
 	} else {
-		for i := 0; i < len(s.forwarders); i++ { //如果本地没有，直接转发包至顶级域名递归查询
-			s.memo.set(pString(p), p.addr)
-			go sendPacket(s.conn, p.message, s.forwarders[i])
+		pool := s.poolFor(q)
+		pq, first := s.memo.add(p, pool.timeout)
+		if !first { //相同的问题已经在向上游查询，等待同一个应答
+			return
 		}
+		fwd := dnsmessage.Message{
+			Header: dnsmessage.Header{
+				ID:               pq.id,
+				RecursionDesired: p.message.RecursionDesired,
+			},
+			Questions:   []dnsmessage.Question{q},
+			Additionals: []dnsmessage.Resource{optResource(s.opt.udpSize)}, //向上游通告本端的UDP负载大小
+		}
+		go s.forward(pool, fwd) //如果本地没有，直接转发包至顶级域名递归查询
 	}
 }
 
-func sendPacket(conn *net.UDPConn, message dnsmessage.Message, addr net.UDPAddr) {
-	packed, err := message.Pack()
-	if err != nil {
-		log.Println(err)
+// poolFor 根据条件转发规则选择上游，没有匹配的规则时使用默认上游
+func (s *DNSService) poolFor(q dnsmessage.Question) *upstreamPool {
+	if r := s.rules.match(q.Name.String()); r != nil {
+		return r.pool
+	}
+	return s.forwarders
+}
+
+// forward 按策略向上游查询，全部失败时返回SERVFAIL
+func (s *DNSService) forward(pool *upstreamPool, query dnsmessage.Message) {
+	resp, err := pool.exchange(query)
+	if err == nil {
+		s.answer(resp)
 		return
 	}
+	if pq, ok := s.memo.resolve(query.ID, query.Questions[0]); ok {
+		s.fail(pq)
+	}
+}
 
-	_, err = conn.WriteToUDP(packed, &addr)
+// answer 把上游的应答按各client的原始ID发送给所有等待该查询的client，并写入缓存
+func (s *DNSService) answer(resp dnsmessage.Message) {
+	pq, ok := s.memo.resolve(resp.ID, resp.Questions[0])
+	if !ok {
+		return
+	}
+	go s.checkQuestion("forward", pq.question, resp.Answers)
+	for _, c := range pq.clients {
+		m := resp
+		m.ID = c.message.ID
+		m.Questions = c.message.Questions
+		go s.reply(c, m)
+	}
+	go s.saveBulk(qString(pq.question), resp)
+}
+
+// fail 上游超时或全部失败，向等待的client返回SERVFAIL
+func (s *DNSService) fail(pq *pendingQuery) {
+	log.Warnf("forward failed, question=%v type=%v", pq.question.Name.String(), pq.question.Type)
+	for _, c := range pq.clients {
+		m := responseTo(c.message)
+		m.RCode = dnsmessage.RCodeServerFailure
+		go s.reply(c, m)
+	}
+}
+
+// reply 按查询到达时的传输协议把应答写回client。
+// client使用了EDNS(0)时应答携带本端OPT，UDP应答超过双方协商的大小时设置TC位
+func (s *DNSService) reply(p Packet, message dnsmessage.Message) {
+	size, edns := clientUDPSize(p.message)
+	message.Additionals = stripOPT(message.Additionals)
+	if edns {
+		message.Additionals = append(message.Additionals, optResource(s.opt.udpSize))
+	}
+	if p.tcp != nil {
+		p.tcp.write(message)
+		return
+	}
+	if size > s.opt.udpSize {
+		size = s.opt.udpSize
+	}
+	packed, err := packLimit(message, size)
 	if err != nil {
 		log.Println(err)
+		return
+	}
+	if _, err = s.conn.WriteToUDP(packed, &p.addr); err != nil {
+		log.Println(err)
 	}
 }
 
 func NewDNService(rwDirPath string, forwarders []net.UDPAddr, opts ...Option) *DNSService {
-	dns := &DNSService{
-		book:       store{data: make(map[string]entry), rwDirPath: rwDirPath},
-		memo:       addrBag{data: make(map[string][]net.UDPAddr)},
-		forwarders: forwarders,
-		opt:        loadOptions(opts...),
+	dns := &DNSService{opt: loadOptions(opts...)}
+	if dns.opt.cachePolicy == nil {
+		dns.opt.cachePolicy, _ = newEvictor("lru")
+	}
+	dns.book = dns.opt.backend
+	if dns.book == nil {
+		dns.book = NewGobBackend(rwDirPath)
+	}
+	dns.cache = newCache(dns.opt.cacheEntries, dns.opt.cacheBytes, dns.opt.cachePolicy)
+	dns.memo = newPendingTable(dns.fail)
+	if dns.opt.forwardTimeout <= 0 {
+		dns.opt.forwardTimeout = defaultForwardTimeout
+	}
+	dns.forwarders = newUpstreamPool(forwarders, dns.opt.strategy, dns.opt.forwardTimeout, dns.opt.udpSize)
+	go dns.forwarders.healthCheck(dns.opt.healthInterval)
+	dns.rules = loadForwardRules(dns.opt.forwardRules, dns.opt.forwardDir, dns.opt)
+	for _, r := range dns.rules {
+		log.Infof("forward rule %v -> %v upstreams, timeout=%v", r.suffix, len(r.pool.upstreams), r.pool.timeout)
+		go r.pool.healthCheck(dns.opt.healthInterval)
+	}
+	if err := dns.book.Load(); err != nil {
+		log.Errorf("load local records error: %v", err)
+	}
+	if m, ok := dns.book.(migrator); ok {
+		for key, e := range m.takeMigrated() {
+			dns.cache.put(key, e)
+		}
+	}
+	go dns.cache.sweepLoop(dns.opt.sweepInterval)
+	if dns.opt.whitelist != nil || len(dns.opt.blackLists) > 0 {
+		lists := newListFetcher(filepath.Join(rwDirPath, listDirName), dns.opt.listRefresh)
+		reload := func() {
+			if dns.opt.whitelist != nil {
+				dns.opt.whitelist.load(lists)
+				fmt.Fprintf(os.Stdout, "whitelist %v rules\n", dns.opt.whitelist.len())
+			}
+			dns.blocks.load(dns.opt.blackLists, lists)
+		}
+		reload()
+		registerSingal(reload)
+		go lists.run(reload)
+	}
+	if dns.opt.zoneDir != "" {
+		dns.zones.load(dns.opt.zoneDir)
+		registerSingal(func() { dns.zones.load(dns.opt.zoneDir) })
 	}
-	dns.book.load()
 
 	go dns.Listen()
 	return dns
 }
 
-func (s *DNSService) save(key string, resource dnsmessage.Resource, old *dnsmessage.Resource) bool {
-	ok := s.book.set(key, resource, old)
-	go s.book.save()
-
-	return ok
-}
-
-func (s *DNSService) saveBulk(key string, resources []dnsmessage.Resource) {
-	s.book.override(key, resources)
-	go s.book.save()
+func (s *DNSService) saveBulk(key string, resp dnsmessage.Message) {
+	e, ok := newCacheEntry(resp, s.opt.cacheMinTTL, s.opt.cacheMaxTTL)
+	if !ok {
+		return
+	}
+	s.cache.put(key, e)
 }
 
+// all 返回本地记录和缓存中的记录，Source标明记录的来源
 func (s *DNSService) all() []get {
-	book := s.book.clone()
 	var recs []get
-	for _, r := range book {
-		for _, v := range r.Resources {
-			body := v.Body.GoString()
-			i := strings.Index(body, "{")
-			recs = append(recs, get{
-				Host: v.Header.Name.String(),
-				TTL:  v.Header.TTL,
-				Type: v.Header.Type.String()[4:],
-				Data: body[i : len(body)-1],
-			})
-		}
+	s.book.Iterate(func(key string, rs []dnsmessage.Resource) bool {
+		recs = appendRecords(recs, sourceLocal, rs)
+		return true
+	})
+	for _, e := range s.cache.clone() {
+		recs = appendRecords(recs, sourceCache, e.Resources)
 	}
 	return recs
 }
 
-func (s *DNSService) remove(key string, r *dnsmessage.Resource) bool {
-	ok := s.book.remove(key, r)
-	if ok {
-		go s.book.save()
+func appendRecords(recs []get, source string, rs []dnsmessage.Resource) []get {
+	for _, v := range rs {
+		recs = append(recs, get{record: fromResource(v), Source: source})
 	}
-	return ok
+	return recs
+}
+
+func (s *DNSService) remove(key string, r *dnsmessage.Resource) bool {
+	return s.book.Remove(key, r)
+}
+
+// newName 域名不区分大小写，本地记录的名称统一保存为小写
+func newName(name string) (dnsmessage.Name, error) {
+	return dnsmessage.NewName(strings.ToLower(name))
 }
 
 func toResource(req request) (dnsmessage.Resource, error) {
-	rName, err := dnsmessage.NewName(req.Host)
+	rName, err := newName(req.Host)
 	none := dnsmessage.Resource{}
 	if err != nil {
 		return none, err
@@ -291,17 +409,21 @@ func toResource(req request) (dnsmessage.Resource, error) {
 		if ip == nil {
 			return none, errIPInvalid
 		}
-		rBody = &dnsmessage.AResource{A: [4]byte{ip[12], ip[13], ip[14], ip[15]}}
+		ip4 := ip.To4()
+		if ip4 == nil {
+			return none, errIPFamily
+		}
+		rBody = &dnsmessage.AResource{A: [4]byte{ip4[0], ip4[1], ip4[2], ip4[3]}}
 	case "NS":
 		rType = dnsmessage.TypeNS
-		ns, err := dnsmessage.NewName(req.Data)
+		ns, err := newName(req.Data)
 		if err != nil {
 			return none, err
 		}
 		rBody = &dnsmessage.NSResource{NS: ns}
 	case "CNAME":
 		rType = dnsmessage.TypeCNAME
-		cname, err := dnsmessage.NewName(req.Data)
+		cname, err := newName(req.Data)
 		if err != nil {
 			return none, err
 		}
@@ -309,25 +431,25 @@ func toResource(req request) (dnsmessage.Resource, error) {
 	case "SOA":
 		rType = dnsmessage.TypeSOA
 		soa := req.SOA
-		soaNS, err := dnsmessage.NewName(soa.NS)
+		soaNS, err := newName(soa.NS)
 		if err != nil {
 			return none, err
 		}
-		soaMBox, err := dnsmessage.NewName(soa.MBox)
+		soaMBox, err := newName(soa.MBox)
 		if err != nil {
 			return none, err
 		}
-		rBody = &dnsmessage.SOAResource{NS: soaNS, MBox: soaMBox, Serial: soa.Serial, Refresh: soa.Refresh, Retry: soa.Retry, Expire: soa.Expire}
+		rBody = &dnsmessage.SOAResource{NS: soaNS, MBox: soaMBox, Serial: soa.Serial, Refresh: soa.Refresh, Retry: soa.Retry, Expire: soa.Expire, MinTTL: soa.MinTTL}
 	case "PTR":
 		rType = dnsmessage.TypePTR
-		ptr, err := dnsmessage.NewName(req.Data)
+		ptr, err := newName(req.Data)
 		if err != nil {
 			return none, err
 		}
 		rBody = &dnsmessage.PTRResource{PTR: ptr}
 	case "MX":
 		rType = dnsmessage.TypeMX
-		mxName, err := dnsmessage.NewName(req.MX.MX)
+		mxName, err := newName(req.MX.MX)
 		if err != nil {
 			return none, err
 		}
@@ -338,19 +460,35 @@ func toResource(req request) (dnsmessage.Resource, error) {
 		if ip == nil {
 			return none, errIPInvalid
 		}
+		if ip.To4() != nil {
+			return none, errIPFamily
+		}
 		var ipV6 [16]byte
 		copy(ipV6[:], ip)
 		rBody = &dnsmessage.AAAAResource{AAAA: ipV6}
 	case "SRV":
 		rType = dnsmessage.TypeSRV
 		srv := req.SRV
-		srvTarget, err := dnsmessage.NewName(srv.Target)
+		srvTarget, err := newName(srv.Target)
 		if err != nil {
 			return none, err
 		}
 		rBody = &dnsmessage.SRVResource{Priority: srv.Priority, Weight: srv.Weight, Port: srv.Port, Target: srvTarget}
 	case "TXT":
-		fallthrough
+		rType = dnsmessage.TypeTXT
+		txt := req.TXT
+		if len(txt) == 0 && req.Data != "" {
+			txt = []string{req.Data}
+		}
+		if len(txt) == 0 {
+			return none, errTXTEmpty
+		}
+		for _, t := range txt {
+			if len(t) > 255 {
+				return none, errTXTTooLong
+			}
+		}
+		rBody = &dnsmessage.TXTResource{TXT: txt}
 	case "OPT":
 		fallthrough
 	default:
@@ -396,7 +534,7 @@ func toRType(sType string) dnsmessage.Type {
 }
 
 func toResourceHeader(name string, sType string) (h dnsmessage.ResourceHeader, err error) {
-	h.Name, err = dnsmessage.NewName(name)
+	h.Name, err = newName(name)
 	if err != nil {
 		return
 	}
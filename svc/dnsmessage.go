@@ -1,7 +1,6 @@
 package svc
 
 import (
-	"fmt"
 	"strings"
 
 	"golang.org/x/net/dns/dnsmessage"
@@ -38,6 +37,16 @@ func rString(r dnsmessage.Resource) string {
 	return sb.String()
 }
 
-func pString(p Packet) string {
-	return fmt.Sprint(p.message.ID)
+// responseTo 根据查询构造应答报文头和问题段
+func responseTo(query dnsmessage.Message) dnsmessage.Message {
+	return dnsmessage.Message{
+		Header: dnsmessage.Header{
+			ID:                 query.ID,
+			Response:           true,
+			OpCode:             query.OpCode,
+			RecursionDesired:   query.RecursionDesired,
+			RecursionAvailable: true,
+		},
+		Questions: query.Questions,
+	}
 }
@@ -0,0 +1,64 @@
+package svc
+
+import (
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+const (
+	// defaultUDPSize 默认通告的EDNS(0) UDP负载大小，参考DNS Flag Day 2020的建议值
+	defaultUDPSize int = 1232
+	maxUDPSize     int = 65535
+)
+
+// clientUDPSize 返回client通过OPT记录通告的UDP负载大小，未携带OPT时按RFC 1035限制为512
+func clientUDPSize(m dnsmessage.Message) (size int, edns bool) {
+	for _, r := range m.Additionals {
+		if r.Header.Type != dnsmessage.TypeOPT {
+			continue
+		}
+		size = int(r.Header.Class)
+		if size < packetLen {
+			size = packetLen //RFC 6891 6.2.3，小于512按512处理
+		}
+		return size, true
+	}
+	return packetLen, false
+}
+
+// optResource 生成本端的OPT伪记录，通告可接收的UDP负载大小
+func optResource(udpSize int) dnsmessage.Resource {
+	var h dnsmessage.ResourceHeader
+	h.SetEDNS0(udpSize, dnsmessage.RCodeSuccess, false)
+	return dnsmessage.Resource{Header: h, Body: &dnsmessage.OPTResource{}}
+}
+
+// stripOPT 去掉附加段中的OPT记录，OPT只在一跳之间有效，不能原样转发或缓存
+func stripOPT(rs []dnsmessage.Resource) []dnsmessage.Resource {
+	var out []dnsmessage.Resource
+	for _, r := range rs {
+		if r.Header.Type != dnsmessage.TypeOPT {
+			out = append(out, r)
+		}
+	}
+	return out
+}
+
+// packLimit 打包报文，超过limit时设置TC位并只保留OPT记录重新打包，
+// client收到后会通过TCP重新查询
+func packLimit(message dnsmessage.Message, limit int) ([]byte, error) {
+	packed, err := message.Pack()
+	if err != nil || len(packed) <= limit {
+		return packed, err
+	}
+	var opt []dnsmessage.Resource
+	for _, r := range message.Additionals {
+		if r.Header.Type == dnsmessage.TypeOPT {
+			opt = append(opt, r)
+		}
+	}
+	message.Truncated = true
+	message.Answers = nil
+	message.Authorities = nil
+	message.Additionals = opt
+	return message.Pack()
+}
@@ -0,0 +1,175 @@
+package svc
+
+import (
+	"container/heap"
+	"container/list"
+	"fmt"
+	"sync"
+)
+
+// evictor 缓存淘汰策略，记录key的访问情况并在缓存满时给出被淘汰的key
+type evictor interface {
+	add(key string)
+	touch(key string)
+	remove(key string)
+	victim(except string) (string, bool) //except为刚写入的key，不作为被淘汰的key
+	name() string
+}
+
+func newEvictor(policy string) (evictor, error) {
+	switch policy {
+	case "", "lru":
+		return &lru{items: make(map[string]*list.Element), order: list.New()}, nil
+	case "lfu":
+		return &lfu{items: make(map[string]*lfuItem)}, nil
+	}
+	return nil, fmt.Errorf("unknown cache policy %q", policy)
+}
+
+// lru 淘汰最久未被访问的key
+type lru struct {
+	sync.Mutex
+	items map[string]*list.Element
+	order *list.List //队首为最近访问
+}
+
+func (l *lru) add(key string) {
+	l.Lock()
+	defer l.Unlock()
+	if el, ok := l.items[key]; ok {
+		l.order.MoveToFront(el)
+		return
+	}
+	l.items[key] = l.order.PushFront(key)
+}
+
+func (l *lru) touch(key string) {
+	l.Lock()
+	defer l.Unlock()
+	if el, ok := l.items[key]; ok {
+		l.order.MoveToFront(el)
+	}
+}
+
+func (l *lru) remove(key string) {
+	l.Lock()
+	defer l.Unlock()
+	if el, ok := l.items[key]; ok {
+		l.order.Remove(el)
+		delete(l.items, key)
+	}
+}
+
+func (l *lru) victim(except string) (string, bool) {
+	l.Lock()
+	defer l.Unlock()
+	for el := l.order.Back(); el != nil; el = el.Prev() {
+		if key := el.Value.(string); key != except {
+			return key, true
+		}
+	}
+	return "", false
+}
+
+func (l *lru) name() string { return "lru" }
+
+// lfu 淘汰访问次数最少的key，次数相同时淘汰最久未被访问的
+type lfu struct {
+	sync.Mutex
+	items map[string]*lfuItem
+	heap  lfuHeap
+	tick  uint64
+}
+
+type lfuItem struct {
+	key   string
+	count uint64
+	last  uint64
+	index int
+}
+
+type lfuHeap []*lfuItem
+
+func (h lfuHeap) Len() int { return len(h) }
+func (h lfuHeap) Less(i, j int) bool {
+	if h[i].count != h[j].count {
+		return h[i].count < h[j].count
+	}
+	return h[i].last < h[j].last
+}
+func (h lfuHeap) Swap(i, j int) {
+	h[i], h[j] = h[j], h[i]
+	h[i].index = i
+	h[j].index = j
+}
+func (h *lfuHeap) Push(x interface{}) {
+	it := x.(*lfuItem)
+	it.index = len(*h)
+	*h = append(*h, it)
+}
+func (h *lfuHeap) Pop() interface{} {
+	old := *h
+	it := old[len(old)-1]
+	old[len(old)-1] = nil
+	*h = old[:len(old)-1]
+	return it
+}
+
+func (l *lfu) add(key string) {
+	l.Lock()
+	defer l.Unlock()
+	l.tick++
+	if it, ok := l.items[key]; ok {
+		it.count++
+		it.last = l.tick
+		heap.Fix(&l.heap, it.index)
+		return
+	}
+	it := &lfuItem{key: key, count: 1, last: l.tick}
+	l.items[key] = it
+	heap.Push(&l.heap, it)
+}
+
+func (l *lfu) touch(key string) {
+	l.Lock()
+	defer l.Unlock()
+	if it, ok := l.items[key]; ok {
+		l.tick++
+		it.count++
+		it.last = l.tick
+		heap.Fix(&l.heap, it.index)
+	}
+}
+
+func (l *lfu) remove(key string) {
+	l.Lock()
+	defer l.Unlock()
+	if it, ok := l.items[key]; ok {
+		heap.Remove(&l.heap, it.index)
+		delete(l.items, key)
+	}
+}
+
+func (l *lfu) victim(except string) (string, bool) {
+	l.Lock()
+	defer l.Unlock()
+	if len(l.heap) == 0 {
+		return "", false
+	}
+	if l.heap[0].key != except {
+		return l.heap[0].key, true
+	}
+	//堆顶是except时，次小的元素是它的两个子节点之一
+	best := -1
+	for i := 1; i <= 2 && i < len(l.heap); i++ {
+		if best < 0 || l.heap.Less(i, best) {
+			best = i
+		}
+	}
+	if best < 0 {
+		return "", false
+	}
+	return l.heap[best].key, true
+}
+
+func (l *lfu) name() string { return "lfu" }
@@ -0,0 +1,322 @@
+package svc
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"sort"
+	"strings"
+
+	"golang.org/x/net/dns/dnsmessage"
+	"gopkg.in/yaml.v2"
+)
+
+// 导出导入支持的格式
+const (
+	FormatJSON = "json"
+	FormatYAML = "yaml"
+	FormatZone = "zone" //RFC 1035 master文件格式，每行一条使用绝对名称的记录
+)
+
+// 导入模式
+const (
+	ImportMerge   = "merge"   //只添加文件中新的记录，保留已有记录
+	ImportReplace = "replace" //导入后本地记录与文件完全一致
+)
+
+// record 一条记录的结构化表示，按类型只填写对应的字段，字段与request一致
+type record struct {
+	Host string
+	TTL  uint32
+	Type string
+	Data string      `json:",omitempty" yaml:",omitempty"` //A, AAAA的地址以及NS, CNAME, PTR的名称
+	MX   *requestMX  `json:",omitempty" yaml:",omitempty"`
+	SRV  *requestSRV `json:",omitempty" yaml:",omitempty"`
+	SOA  *requestSOA `json:",omitempty" yaml:",omitempty"`
+	TXT  []string    `json:",omitempty" yaml:",omitempty"`
+}
+
+// fromResource 是toResource的逆过程
+func fromResource(r dnsmessage.Resource) record {
+	rec := record{Host: r.Header.Name.String(), TTL: r.Header.TTL, Type: strings.TrimPrefix(r.Header.Type.String(), "Type")}
+	switch b := r.Body.(type) {
+	case *dnsmessage.AResource:
+		rec.Data = net.IP(b.A[:]).String()
+	case *dnsmessage.AAAAResource:
+		rec.Data = net.IP(b.AAAA[:]).String()
+	case *dnsmessage.NSResource:
+		rec.Data = b.NS.String()
+	case *dnsmessage.CNAMEResource:
+		rec.Data = b.CNAME.String()
+	case *dnsmessage.PTRResource:
+		rec.Data = b.PTR.String()
+	case *dnsmessage.MXResource:
+		rec.MX = &requestMX{Pref: b.Pref, MX: b.MX.String()}
+	case *dnsmessage.SRVResource:
+		rec.SRV = &requestSRV{Priority: b.Priority, Weight: b.Weight, Port: b.Port, Target: b.Target.String()}
+	case *dnsmessage.SOAResource:
+		rec.SOA = &requestSOA{NS: b.NS.String(), MBox: b.MBox.String(), Serial: b.Serial,
+			Refresh: b.Refresh, Retry: b.Retry, Expire: b.Expire, MinTTL: b.MinTTL}
+	case *dnsmessage.TXTResource:
+		rec.TXT = b.TXT
+	}
+	return rec
+}
+
+func (rec record) request() request {
+	req := request{Host: rec.Host, TTL: rec.TTL, Type: strings.ToUpper(rec.Type), Data: rec.Data, TXT: rec.TXT}
+	if rec.MX != nil {
+		req.MX = *rec.MX
+	}
+	if rec.SRV != nil {
+		req.SRV = *rec.SRV
+	}
+	if rec.SOA != nil {
+		req.SOA = *rec.SOA
+	}
+	return req
+}
+
+// zoneLine 把记录格式化为zone文件中的一行
+func zoneLine(r dnsmessage.Resource) string {
+	rec := fromResource(r)
+	var rdata string
+	switch {
+	case rec.MX != nil:
+		rdata = fmt.Sprintf("%v %v", rec.MX.Pref, rec.MX.MX)
+	case rec.SRV != nil:
+		rdata = fmt.Sprintf("%v %v %v %v", rec.SRV.Priority, rec.SRV.Weight, rec.SRV.Port, rec.SRV.Target)
+	case rec.SOA != nil:
+		rdata = fmt.Sprintf("%v %v %v %v %v %v %v", rec.SOA.NS, rec.SOA.MBox, rec.SOA.Serial,
+			rec.SOA.Refresh, rec.SOA.Retry, rec.SOA.Expire, rec.SOA.MinTTL)
+	case rec.TXT != nil:
+		quoted := make([]string, len(rec.TXT))
+		for i, t := range rec.TXT {
+			quoted[i] = quoteTXT(t)
+		}
+		rdata = strings.Join(quoted, " ")
+	default:
+		rdata = rec.Data
+	}
+	return fmt.Sprintf("%v\t%v\tIN\t%v\t%v", rec.Host, rec.TTL, rec.Type, rdata)
+}
+
+// quoteTXT 加上引号，"和\转义，不可打印字符使用\DDD
+func quoteTXT(s string) string {
+	var b strings.Builder
+	b.WriteByte('"')
+	for i := 0; i < len(s); i++ {
+		switch c := s[i]; {
+		case c == '"' || c == '\\':
+			b.WriteByte('\\')
+			b.WriteByte(c)
+		case c < ' ' || c > '~':
+			fmt.Fprintf(&b, "\\%03d", c)
+		default:
+			b.WriteByte(c)
+		}
+	}
+	b.WriteByte('"')
+	return b.String()
+}
+
+// sortedResources 按key排序后展开，保证导出的结果稳定，便于diff
+func sortedResources(data map[string][]dnsmessage.Resource) []dnsmessage.Resource {
+	keys := make([]string, 0, len(data))
+	for k := range data {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	var rs []dnsmessage.Resource
+	for _, k := range keys {
+		rs = append(rs, data[k]...)
+	}
+	return rs
+}
+
+// ExportRecords 把本地记录按format写入w
+func ExportRecords(b Backend, w io.Writer, format string) error {
+	return encodeRecords(w, sortedResources(b.Snapshot()), format)
+}
+
+func encodeRecords(w io.Writer, rs []dnsmessage.Resource, format string) error {
+	switch format {
+	case FormatJSON, "":
+		recs := make([]record, len(rs))
+		for i, r := range rs {
+			recs[i] = fromResource(r)
+		}
+		enc := json.NewEncoder(w)
+		enc.SetIndent("", "  ")
+		return enc.Encode(recs)
+	case FormatYAML:
+		recs := make([]record, len(rs))
+		for i, r := range rs {
+			recs[i] = fromResource(r)
+		}
+		enc := yaml.NewEncoder(w)
+		if err := enc.Encode(recs); err != nil {
+			return err
+		}
+		return enc.Close()
+	case FormatZone:
+		for _, r := range rs {
+			if _, err := fmt.Fprintln(w, zoneLine(r)); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	return fmt.Errorf("unknown format %q", format)
+}
+
+func decodeRecords(r io.Reader, format, file string) ([]dnsmessage.Resource, error) {
+	var recs []record
+	switch format {
+	case FormatJSON, "":
+		if err := json.NewDecoder(r).Decode(&recs); err != nil {
+			return nil, err
+		}
+	case FormatYAML: //YAML的字段名为JSON字段名的小写形式，不允许未知的字段
+		dec := yaml.NewDecoder(r)
+		dec.SetStrict(true)
+		if err := dec.Decode(&recs); err != nil && err != io.EOF {
+			return nil, err
+		}
+	case FormatZone:
+		return parseZone(r, "", file)
+	default:
+		return nil, fmt.Errorf("unknown format %q", format)
+	}
+	rs := make([]dnsmessage.Resource, len(recs))
+	for i, rec := range recs {
+		res, err := toResource(rec.request())
+		if err != nil {
+			return nil, fmt.Errorf("record %v (%v %v): %v", i+1, rec.Host, rec.Type, err)
+		}
+		rs[i] = res
+	}
+	return rs, nil
+}
+
+// ImportRecords 从文件file中读取记录写入b，mode为merge或replace，merge时文件中的记录
+// 与已有记录只有TTL不同的更新TTL。变更以zone文件格式写入out，+为新增，-为删除；
+// dryRun为true时只输出不修改
+func ImportRecords(b Backend, r io.Reader, file, format, mode string, dryRun bool, out io.Writer) error {
+	if mode != ImportMerge && mode != ImportReplace {
+		return fmt.Errorf("unknown import mode %q", mode)
+	}
+	rs, err := decodeRecords(r, format, file)
+	if err != nil {
+		return err
+	}
+
+	current := b.Snapshot()
+	next := make(map[string][]dnsmessage.Resource)
+	if mode == ImportMerge {
+		for k, v := range current {
+			next[k] = append([]dnsmessage.Resource(nil), v...)
+		}
+	}
+	for _, r := range rs {
+		key := ntString(r.Header.Name, r.Header.Type)
+		if i := indexResource(next[key], r); i >= 0 {
+			next[key][i] = r
+		} else {
+			next[key] = append(next[key], r)
+		}
+	}
+
+	var added, removed int
+	changed := make(map[string][]dnsmessage.Resource)
+	for _, k := range sortedKeys(current, next) {
+		for _, r := range current[k] {
+			if !containsResource(next[k], r) {
+				fmt.Fprintln(out, "-", zoneLine(r))
+				removed++
+			}
+		}
+		for _, r := range next[k] {
+			if !containsResource(current[k], r) {
+				fmt.Fprintln(out, "+", zoneLine(r))
+				added++
+			}
+		}
+		if !sameResources(current[k], next[k]) {
+			changed[k] = next[k]
+		}
+	}
+	fmt.Fprintf(out, "%v added, %v removed\n", added, removed)
+	if dryRun || len(changed) == 0 {
+		return nil
+	}
+	//所有修改在一个Batch中生效，只持久化一次
+	return b.Batch(func(tx *Tx) error {
+		for k, rs := range changed {
+			tx.Override(k, rs)
+		}
+		return nil
+	})
+}
+
+// sortedKeys 返回两个map中所有key的有序并集
+func sortedKeys(a, b map[string][]dnsmessage.Resource) []string {
+	var keys []string
+	for k := range a {
+		keys = append(keys, k)
+	}
+	for k := range b {
+		if _, ok := a[k]; !ok {
+			keys = append(keys, k)
+		}
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// indexResource 返回rs中与r只有TTL可能不同的记录的下标
+func indexResource(rs []dnsmessage.Resource, r dnsmessage.Resource) int {
+	for i, v := range rs {
+		if rString(v) == rString(r) {
+			return i
+		}
+	}
+	return -1
+}
+
+// containsResource 判断rs中是否有与r完全相同(包括TTL)的记录
+func containsResource(rs []dnsmessage.Resource, r dnsmessage.Resource) bool {
+	for _, v := range rs {
+		if rString(v) == rString(r) && v.Header.TTL == r.Header.TTL {
+			return true
+		}
+	}
+	return false
+}
+
+func sameResources(a, b []dnsmessage.Resource) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for _, r := range a {
+		if !containsResource(b, r) {
+			return false
+		}
+	}
+	return true
+}
+
+// ParseFormat format为空时根据文件扩展名推断格式，默认为json
+func ParseFormat(file, format string) string {
+	if format != "" {
+		return format
+	}
+	switch {
+	case strings.HasSuffix(file, ".yaml"), strings.HasSuffix(file, ".yml"):
+		return FormatYAML
+	case strings.HasSuffix(file, ".zone"), strings.HasSuffix(file, ".db"):
+		return FormatZone
+	}
+	return FormatJSON
+}
@@ -0,0 +1,151 @@
+package svc
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+func TestExportImport(t *testing.T) {
+	src := NewMemoryBackend()
+	if err := ImportRecords(src, strings.NewReader(testZone), "test.zone", FormatZone, ImportMerge, false, ioutil.Discard); err != nil {
+		t.Fatal(err)
+	}
+	want := sortedResources(src.Snapshot())
+	if len(want) != 12 {
+		t.Fatalf("imported %v records, want 12", len(want))
+	}
+
+	for _, format := range []string{FormatJSON, FormatYAML, FormatZone} {
+		var buf bytes.Buffer
+		if err := ExportRecords(src, &buf, format); err != nil {
+			t.Fatal(err)
+		}
+		dst := NewMemoryBackend()
+		if err := ImportRecords(dst, &buf, "export", format, ImportReplace, false, ioutil.Discard); err != nil {
+			t.Fatalf("%v: %v", format, err)
+		}
+		got := sortedResources(dst.Snapshot())
+		if len(got) != len(want) {
+			t.Errorf("%v: got %v records, want %v", format, len(got), len(want))
+			continue
+		}
+		for i := range got {
+			if zoneLine(got[i]) != zoneLine(want[i]) {
+				t.Errorf("%v: got %q, want %q", format, zoneLine(got[i]), zoneLine(want[i]))
+			}
+		}
+	}
+
+	var out bytes.Buffer
+	update := "www.example.com. 60 IN CNAME mail.example.com.\nnew.example.com. 60 IN A 192.0.2.77\n"
+	if err := ImportRecords(src, strings.NewReader(update), "update.zone", FormatZone, ImportReplace, true, &out); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasSuffix(out.String(), "2 added, 12 removed\n") || len(sortedResources(src.Snapshot())) != 12 {
+		t.Errorf("dry run changed the store or reported wrong diff: %q", out.String())
+	}
+}
+
+func TestDecodeYAML(t *testing.T) {
+	for _, c := range []struct {
+		data string
+		want []string //zoneLine中的字段以空格分隔，nil表示解析失败
+	}{
+		{`- host: "a.example." # 注释
+  ttl: 60
+  type: A
+  data: '192.0.2.1' # 注释
+`, []string{"a.example. 60 IN A 192.0.2.1"}},
+		{`[{host: t.example., ttl: 60, type: TXT, txt: ["x\ty", 'it''s', "é\x41"]}]`,
+			[]string{"t.example. 60 IN TXT \"x\\009y\" \"it's\" \"\\195\\169A\""}},
+		{`- {host: m.example., ttl: 60, type: MX, mx: {pref: 10, mx: mail.example.}}`,
+			[]string{"m.example. 60 IN MX 10 mail.example."}},
+		{"", []string{}},
+		{"- host: a.example.\n  ttl: 60\n  type: A\n  addr: 192.0.2.1\n", nil},
+	} {
+		rs, err := decodeRecords(strings.NewReader(c.data), FormatYAML, "test.yaml")
+		if c.want == nil {
+			if err == nil {
+				t.Errorf("%q: want error", c.data)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%q: %v", c.data, err)
+			continue
+		}
+		var got []string
+		for _, r := range rs {
+			got = append(got, strings.Join(strings.Fields(zoneLine(r)), " "))
+		}
+		if strings.Join(got, "\n") != strings.Join(c.want, "\n") {
+			t.Errorf("%q: got %q, want %q", c.data, got, c.want)
+		}
+	}
+}
+
+func TestImportDryRunGob(t *testing.T) {
+	dir, err := ioutil.TempDir("", "import")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	b := NewGobBackend(dir)
+	exerciseBackend(t, b)
+	b.Close()
+	b.Remove(ntString(dnsmessage.MustNewName("b.example."), dnsmessage.TypeA), nil)
+	b.Close() //store和store_bk都存在
+	read := func() (string, string) {
+		store, _ := ioutil.ReadFile(filepath.Join(dir, storeName))
+		bk, _ := ioutil.ReadFile(filepath.Join(dir, storeBkName))
+		return string(store), string(bk)
+	}
+	store, bk := read()
+
+	for _, c := range []struct {
+		data   string
+		dryRun bool
+	}{
+		{"new.example. 60 IN A 192.0.2.77\n", true}, //dry run
+		{"a.example. 600 IN A 192.0.2.3\n", false},  //没有变更
+	} {
+		b = NewGobBackend(dir)
+		b.Load()
+		if err := ImportRecords(b, strings.NewReader(c.data), "test.zone", FormatZone, ImportMerge, c.dryRun, ioutil.Discard); err != nil {
+			t.Fatal(err)
+		}
+		b.Close()
+		if s, k := read(); s != store || k != bk {
+			t.Errorf("import %q dryRun=%v rewrote the store files", c.data, c.dryRun)
+		}
+	}
+}
+
+func TestLockRWDir(t *testing.T) {
+	dir, err := ioutil.TempDir("", "lock")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	lock, err := LockRWDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := LockRWDir(dir); err == nil {
+		t.Error("locked twice")
+	}
+	lock.Close()
+	lock, err = LockRWDir(dir)
+	if err != nil {
+		t.Fatalf("lock after release: %v", err)
+	}
+	lock.Close()
+}
@@ -0,0 +1,101 @@
+package svc
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+	"time"
+)
+
+// forwardRule 条件转发规则，名称以suffix结尾的查询转发到该规则自己的上游
+type forwardRule struct {
+	suffix string //小写，以.结尾
+	pool   *upstreamPool
+}
+
+type forwardRules []*forwardRule
+
+// parseForwardRule 解析一条规则："域名后缀 上游列表 [超时] [策略]"，
+// 如 "corp.internal. 10.0.0.53,10.0.0.54:53 2s failover"
+func parseForwardRule(line string, opts *Options) (*forwardRule, error) {
+	fields := strings.Fields(line)
+	if len(fields) < 2 {
+		return nil, fmt.Errorf("forward rule %q: need suffix and upstreams", line)
+	}
+	suffix := strings.ToLower(fields[0])
+	if !strings.HasSuffix(suffix, ".") {
+		suffix += "."
+	}
+	addrs, err := ParseUDPAddrs(strings.Split(fields[1], ","), udpPort)
+	if err != nil {
+		return nil, fmt.Errorf("forward rule %q: %v", line, err)
+	}
+	if len(addrs) == 0 {
+		return nil, fmt.Errorf("forward rule %q: no upstream", line)
+	}
+	timeout := opts.forwardTimeout
+	if len(fields) > 2 {
+		if timeout, err = time.ParseDuration(fields[2]); err != nil {
+			return nil, fmt.Errorf("forward rule %q: %v", line, err)
+		}
+	}
+	st := opts.strategy
+	if len(fields) > 3 {
+		if st, err = parseStrategy(fields[3]); err != nil {
+			return nil, fmt.Errorf("forward rule %q: %v", line, err)
+		}
+	}
+	if timeout <= 0 {
+		timeout = defaultForwardTimeout
+	}
+	return &forwardRule{suffix: suffix, pool: newUpstreamPool(addrs, st, timeout, opts.udpSize)}, nil
+}
+
+// loadForwardRules 解析配置文件中的规则以及规则目录下的所有文件，
+// 目录中的文件每行一条规则，#开头为注释。有错误的规则记录日志后跳过
+func loadForwardRules(lines []string, dir string, opts *Options) forwardRules {
+	if dir != "" {
+		for _, file := range queryFiles(dir) {
+			f, err := os.Open(file)
+			if err != nil {
+				log.Errorf("open forward rule file %v error: %v", file, err)
+				continue
+			}
+			scanner := bufio.NewScanner(f)
+			for scanner.Scan() {
+				line := strings.TrimSpace(scanner.Text())
+				if line == "" || line[0] == '#' {
+					continue
+				}
+				lines = append(lines, line)
+			}
+			f.Close()
+		}
+	}
+
+	var rules forwardRules
+	for _, line := range lines {
+		rule, err := parseForwardRule(line, opts)
+		if err != nil {
+			log.Error(err)
+			continue
+		}
+		rules = append(rules, rule)
+	}
+	//后缀越长越具体，优先匹配
+	sort.SliceStable(rules, func(i, j int) bool { return len(rules[i].suffix) > len(rules[j].suffix) })
+	return rules
+}
+
+// match 返回与name匹配的最具体的规则，没有匹配时返回nil
+func (rs forwardRules) match(name string) *forwardRule {
+	name = strings.ToLower(name)
+	for _, r := range rs {
+		if r.suffix == "." || name == r.suffix || strings.HasSuffix(name, "."+r.suffix) {
+			return r
+		}
+	}
+	return nil
+}
@@ -0,0 +1,61 @@
+package svc
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestParseForwardRule(t *testing.T) {
+	dir, err := ioutil.TempDir("", "conf")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	//与README中的写法相同，行尾带有//注释
+	conf := filepath.Join(dir, "confile")
+	ioutil.WriteFile(conf, []byte(`forward_rule corp.internal. 10.0.0.53,10.0.0.54 2s failover //条件转发：后缀 上游列表 [超时] [策略]
+forward_rule lab.internal 10.0.0.55 //只有后缀和上游
+forward_rule bad.internal. 10.0.0.56 soon //超时无效
+forward_rule odd.internal. 10.0.0.57 1s sometimes
+`), 0666)
+	saved := GCONF.ForwardRules
+	GCONF.ForwardRules = nil
+	defer func() { GCONF.ForwardRules = saved }()
+	ParseFile(conf)
+	if len(GCONF.ForwardRules) != 4 {
+		t.Fatalf("got forward rules %q", GCONF.ForwardRules)
+	}
+
+	opts := &Options{forwardTimeout: 5 * time.Second}
+	for i, c := range []struct {
+		suffix    string
+		upstreams int
+		timeout   time.Duration
+		err       bool
+	}{
+		{"corp.internal.", 2, 2 * time.Second, false},
+		{"lab.internal.", 1, 5 * time.Second, false},
+		{"", 0, 0, true},
+		{"", 0, 0, true},
+	} {
+		line := GCONF.ForwardRules[i]
+		r, err := parseForwardRule(line, opts)
+		if c.err {
+			if err == nil {
+				t.Errorf("%q: want error", line)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%q: %v", line, err)
+			continue
+		}
+		if r.suffix != c.suffix || len(r.pool.upstreams) != c.upstreams || r.pool.timeout != c.timeout {
+			t.Errorf("%q: got %v %v upstreams timeout %v", line, r.suffix, len(r.pool.upstreams), r.pool.timeout)
+		}
+	}
+}
@@ -0,0 +1,294 @@
+package svc
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/gob"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+const (
+	//本地记录保存至本地文件，采用gob编码，每次重启会重新加载文件值至内存
+	storeName    string = "store"
+	storeBkName  string = "store_bk"
+	storeTmpName string = "store.tmp"
+
+	//文件头：magic + 2字节版本号(大端)
+	storeMagic   string = "DNSSTORE"
+	storeVersion uint16 = 1
+
+	defaultSaveDelay = time.Second
+)
+
+// gobStore 每次变更后把全部记录保存为一个gob快照文件
+type gobStore struct {
+	*store
+	rwDirPath string
+	dirty     chan struct{}
+	changed   int32         //有未保存的变更时为1
+	quit      chan struct{} //Close时关闭，通知saveLoop退出
+	done      chan struct{} //saveLoop退出后关闭
+	stop      sync.Once
+	saveMu    sync.Mutex //保证同一时间只有一个save
+}
+
+// NewGobBackend 返回把记录保存在rwDirPath/store中的后端
+func NewGobBackend(rwDirPath string) Backend {
+	g := &gobStore{
+		store:     newStore(),
+		rwDirPath: rwDirPath,
+		dirty:     make(chan struct{}, 1),
+		quit:      make(chan struct{}),
+		done:      make(chan struct{}),
+	}
+	go g.saveLoop(defaultSaveDelay)
+	return g
+}
+
+func (g *gobStore) Set(key string, r dnsmessage.Resource, old *dnsmessage.Resource) bool {
+	ok := g.store.Set(key, r, old)
+	if ok {
+		g.markDirty()
+	}
+	return ok
+}
+
+func (g *gobStore) Override(key string, rs []dnsmessage.Resource) {
+	g.store.Override(key, rs)
+	g.markDirty()
+}
+
+func (g *gobStore) Remove(key string, r *dnsmessage.Resource) bool {
+	ok := g.store.Remove(key, r)
+	if ok {
+		g.markDirty()
+	}
+	return ok
+}
+
+func (g *gobStore) Batch(fn func(tx *Tx) error) error {
+	g.Lock()
+	changes, err := g.batchLocked(fn)
+	g.Unlock()
+	if len(changes) > 0 {
+		g.markDirty()
+	}
+	return err
+}
+
+// Close 停止saveLoop并等待其退出，有未保存的变更时保存一次
+func (g *gobStore) Close() error {
+	g.stop.Do(func() {
+		close(g.quit)
+		<-g.done
+	})
+	return g.flush()
+}
+
+// markDirty 通知saveLoop有变更需要保存，不阻塞
+func (g *gobStore) markDirty() {
+	atomic.StoreInt32(&g.changed, 1)
+	select {
+	case g.dirty <- struct{}{}:
+	default:
+	}
+}
+
+// saveLoop 合并delay时间内的多次变更为一次保存，Close后退出，未保存的变更由Close保存
+func (g *gobStore) saveLoop(delay time.Duration) {
+	defer close(g.done)
+	timer := time.NewTimer(delay)
+	timer.Stop()
+	for {
+		select {
+		case <-g.quit:
+			return
+		case <-g.dirty:
+		}
+		timer.Reset(delay)
+		select {
+		case <-g.quit:
+			timer.Stop()
+			return
+		case <-timer.C:
+		}
+		select { //等待期间的变更已包含在本次保存中
+		case <-g.dirty:
+		default:
+		}
+		if err := g.flush(); err != nil {
+			log.Errorf("save store error: %v", err)
+		}
+	}
+}
+
+// flush 有未保存的变更时保存，没有变更时不改动store和store_bk
+func (g *gobStore) flush() error {
+	if atomic.SwapInt32(&g.changed, 0) == 0 {
+		return nil
+	}
+	if err := g.save(); err != nil {
+		atomic.StoreInt32(&g.changed, 1)
+		return err
+	}
+	return nil
+}
+
+// save 写入临时文件并fsync后rename替换，原文件rename为store_bk，
+// 任意时刻崩溃store和store_bk中至少有一个是完整的
+func (g *gobStore) save() error {
+	g.saveMu.Lock()
+	defer g.saveMu.Unlock()
+	data := make(map[string]entry)
+	g.Iterate(func(k string, rs []dnsmessage.Resource) bool {
+		data[k] = entry{Resources: rs, TTL: rrsetTTL(rs)}
+		return true
+	})
+	var buf bytes.Buffer
+	buf.WriteString(storeMagic)
+	binary.Write(&buf, binary.BigEndian, storeVersion)
+	if err := gob.NewEncoder(&buf).Encode(data); err != nil {
+		return err
+	}
+	return writeFileAtomic(g.rwDirPath, storeName, storeBkName, storeTmpName, buf.Bytes())
+}
+
+// writeFileAtomic 写入临时文件并fsync后rename为name，原文件rename为bk(bk为空时直接覆盖)
+func writeFileAtomic(dir, name, bk, tmpName string, data []byte) error {
+	tmp := filepath.Join(dir, tmpName)
+	f, err := os.OpenFile(tmp, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0666)
+	if err != nil {
+		return err
+	}
+	if _, err = f.Write(data); err == nil {
+		err = f.Sync()
+	}
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		os.Remove(tmp)
+		return err
+	}
+
+	dst := filepath.Join(dir, name)
+	if bk != "" {
+		if err = os.Rename(dst, filepath.Join(dir, bk)); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	if err = os.Rename(tmp, dst); err != nil {
+		return err
+	}
+	return syncDir(dir)
+}
+
+// syncDir 保证rename已落盘
+func syncDir(dir string) error {
+	d, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer d.Close()
+	return d.Sync()
+}
+
+// Load 加载store文件，文件不存在或损坏时依次尝试store_bk，都失败时以空的store启动
+func (g *gobStore) Load() error {
+	records, cached, name := readStoreRecords(g.rwDirPath)
+	if records == nil {
+		log.Warnf("no usable store file in %v, start with empty store", g.rwDirPath)
+		return nil
+	}
+	g.Lock()
+	for key, rs := range records {
+		g.data[key] = rs
+	}
+	g.migrated = cached
+	g.Unlock()
+	log.Infof("load %v local records from %v", len(records), name)
+	return nil
+}
+
+// readStoreRecords 依次读取dir下的store和store_bk，返回第一个可用文件中的本地记录，
+// 旧版本文件中的上游应答和文件名，都不可用时返回nil。只读取，不修改文件
+func readStoreRecords(dir string) (map[string][]dnsmessage.Resource, map[string]entry, string) {
+	for _, name := range []string{storeName, storeBkName} {
+		data, legacy, err := readStore(filepath.Join(dir, name))
+		if os.IsNotExist(err) {
+			continue
+		}
+		if err != nil {
+			log.Errorf("load store file %v error: %v", name, err)
+			continue
+		}
+		records, cached := storeRecords(name, data, legacy)
+		return records, cached, name
+	}
+	return nil, nil, ""
+}
+
+// storeRecords 返回store文件中的本地记录。旧版本文件中混有上游应答的缓存：
+// 否定应答不加载，TTL不大于1的是本地记录，其余的是上游应答，未过期的作为缓存返回，已过期的丢弃
+func storeRecords(name string, data map[string]entry, legacy bool) (map[string][]dnsmessage.Resource, map[string]entry) {
+	now := time.Now().Unix()
+	records := make(map[string][]dnsmessage.Resource)
+	var cached map[string]entry
+	dropped := 0
+	for key, e := range data {
+		if len(e.Resources) == 0 {
+			continue
+		}
+		if legacy && e.TTL > 1 {
+			if e.expired(now) {
+				dropped++
+				continue
+			}
+			if cached == nil {
+				cached = make(map[string]entry)
+			}
+			cached[key] = e
+			continue
+		}
+		records[key] = e.Resources
+	}
+	if legacy {
+		log.Warnf("migrate old store file %v: keep %v local records, move %v cached answers to the cache, drop %v expired ones",
+			name, len(records), len(cached), dropped)
+	}
+	return records, cached
+}
+
+// readStore 读取并校验文件头，没有文件头的按旧版本的纯gob格式解析，此时legacy为true
+func readStore(file string) (data map[string]entry, legacy bool, err error) {
+	raw, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, false, err
+	}
+	body := raw
+	if bytes.HasPrefix(raw, []byte(storeMagic)) {
+		if len(raw) < len(storeMagic)+2 {
+			return nil, false, fmt.Errorf("truncated header")
+		}
+		version := binary.BigEndian.Uint16(raw[len(storeMagic):])
+		if version != storeVersion {
+			return nil, false, fmt.Errorf("unsupported store version %v", version)
+		}
+		body = raw[len(storeMagic)+2:]
+	} else {
+		legacy = true
+	}
+	data = make(map[string]entry)
+	if err := gob.NewDecoder(bytes.NewReader(body)).Decode(&data); err != nil {
+		return nil, false, err
+	}
+	return data, legacy, nil
+}
@@ -48,7 +48,6 @@ func parseIP(ipString string) (domain string, err error) {
 			} else {
 				return fmt.Sprintf("%v/%v", ip_v6.String(), len), nil
 			}
-			return ip_v6.String(), nil
 		}
 	} else if len(c) == net.IPv4len {
 		var ipv4Byte [4]byte
@@ -0,0 +1,282 @@
+package svc
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"encoding/gob"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"os"
+	"path/filepath"
+
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+const (
+	journalName    = "journal"
+	journalTmpName = "journal.tmp"
+
+	//日志中的操作数超过记录数的journalCompactRatio倍且不少于journalCompactMin时压缩
+	journalCompactRatio = 4
+	journalCompactMin   = 1024
+
+	//单条变更的最大长度，长度头超过该值视为损坏，避免按损坏的长度分配内存
+	maxJournalOpSize = 16 << 20
+)
+
+// 日志中的操作类型
+const (
+	journalSet uint8 = iota + 1
+	journalOverride
+	journalRemove
+	journalBatch
+)
+
+// journalOp 一次变更，每条变更单独gob编码，前面加上4字节长度和4字节crc32
+type journalOp struct {
+	Op        uint8
+	Key       string
+	Resource  dnsmessage.Resource
+	Old       *dnsmessage.Resource
+	Resources []dnsmessage.Resource
+	Changes   map[string][]dnsmessage.Resource //journalBatch修改的RRset，写在同一条变更中，重放时同时生效
+}
+
+// journalStore 每次变更追加写入并fsync，启动时重放日志；日志过长时压缩为每个key一条override
+type journalStore struct {
+	*store
+	rwDirPath string
+	file      *os.File
+	ops       int //日志中的操作数
+}
+
+// NewJournalBackend 返回把变更追加写入rwDirPath/journal的后端
+func NewJournalBackend(rwDirPath string) Backend {
+	return &journalStore{store: newStore(), rwDirPath: rwDirPath}
+}
+
+func (j *journalStore) Set(key string, r dnsmessage.Resource, old *dnsmessage.Resource) bool {
+	j.Lock()
+	defer j.Unlock()
+	if !j.setLocked(key, r, old) {
+		return false
+	}
+	j.appendLocked(journalOp{Op: journalSet, Key: key, Resource: r, Old: old})
+	return true
+}
+
+func (j *journalStore) Override(key string, rs []dnsmessage.Resource) {
+	j.Lock()
+	defer j.Unlock()
+	j.overrideLocked(key, rs)
+	j.appendLocked(journalOp{Op: journalOverride, Key: key, Resources: rs})
+}
+
+func (j *journalStore) Remove(key string, r *dnsmessage.Resource) bool {
+	j.Lock()
+	defer j.Unlock()
+	if !j.removeLocked(key, r) {
+		return false
+	}
+	j.appendLocked(journalOp{Op: journalRemove, Key: key, Old: r})
+	return true
+}
+
+func (j *journalStore) Batch(fn func(tx *Tx) error) error {
+	j.Lock()
+	defer j.Unlock()
+	changes, err := j.batchLocked(fn)
+	if len(changes) > 0 {
+		j.appendLocked(journalOp{Op: journalBatch, Key: "batch", Changes: changes})
+	}
+	return err
+}
+
+func (j *journalStore) Close() error {
+	j.Lock()
+	defer j.Unlock()
+	if j.file == nil {
+		return nil
+	}
+	err := j.file.Close()
+	j.file = nil
+	return err
+}
+
+// apply 重放一条变更，调用方需持有写锁
+func (j *journalStore) apply(op journalOp) error {
+	switch op.Op {
+	case journalSet:
+		j.setLocked(op.Key, op.Resource, op.Old)
+	case journalOverride:
+		j.overrideLocked(op.Key, op.Resources)
+	case journalRemove:
+		j.removeLocked(op.Key, op.Old)
+	case journalBatch:
+		for key, rs := range op.Changes {
+			j.overrideLocked(key, rs)
+		}
+	default:
+		return fmt.Errorf("unknown journal op %v", op.Op)
+	}
+	return nil
+}
+
+// appendLocked 追加一条变更并fsync，调用方需持有写锁。写入失败时内存中的修改仍然生效，
+// 记录日志，下一次压缩会重新写入完整的记录
+func (j *journalStore) appendLocked(ops ...journalOp) {
+	if j.file == nil {
+		log.Errorf("journal is not open, change of %v is not persisted", ops[0].Key)
+		return
+	}
+	var buf bytes.Buffer
+	for _, op := range ops {
+		if err := encodeJournalOp(&buf, op); err != nil {
+			log.Errorf("encode journal op %v error: %v", op.Key, err)
+			return
+		}
+	}
+	if _, err := j.file.Write(buf.Bytes()); err != nil {
+		log.Errorf("write journal error: %v", err)
+		return
+	}
+	if err := j.file.Sync(); err != nil {
+		log.Errorf("sync journal error: %v", err)
+	}
+	j.ops += len(ops)
+	if j.ops >= journalCompactMin && j.ops > journalCompactRatio*len(j.data) {
+		if err := j.compactLocked(); err != nil {
+			log.Errorf("compact journal error: %v", err)
+		}
+	}
+}
+
+func encodeJournalOp(w io.Writer, op journalOp) error {
+	var payload bytes.Buffer
+	if err := gob.NewEncoder(&payload).Encode(op); err != nil {
+		return err
+	}
+	if payload.Len() > maxJournalOpSize {
+		return fmt.Errorf("record length %v exceeds %v", payload.Len(), maxJournalOpSize)
+	}
+	var head [8]byte
+	binary.BigEndian.PutUint32(head[:4], uint32(payload.Len()))
+	binary.BigEndian.PutUint32(head[4:], crc32.ChecksumIEEE(payload.Bytes()))
+	if _, err := w.Write(head[:]); err != nil {
+		return err
+	}
+	_, err := w.Write(payload.Bytes())
+	return err
+}
+
+// decodeJournalOp 读取一条变更，文件末尾返回io.EOF，不完整、超长或校验失败的返回其他错误
+func decodeJournalOp(r io.Reader) (op journalOp, n int64, err error) {
+	var head [8]byte
+	if _, err = io.ReadFull(r, head[:]); err != nil {
+		if err == io.ErrUnexpectedEOF {
+			err = fmt.Errorf("truncated record header")
+		}
+		return op, 0, err
+	}
+	size := binary.BigEndian.Uint32(head[:4])
+	if size > maxJournalOpSize {
+		return op, 0, fmt.Errorf("record length %v exceeds %v", size, maxJournalOpSize)
+	}
+	payload := make([]byte, size)
+	if _, err = io.ReadFull(r, payload); err != nil {
+		return op, 0, fmt.Errorf("truncated record")
+	}
+	if crc32.ChecksumIEEE(payload) != binary.BigEndian.Uint32(head[4:]) {
+		return op, 0, fmt.Errorf("checksum mismatch")
+	}
+	if err = gob.NewDecoder(bytes.NewReader(payload)).Decode(&op); err != nil {
+		return op, 0, err
+	}
+	return op, int64(len(head) + len(payload)), nil
+}
+
+// Load 重放日志。崩溃时写了一半的最后一条变更被丢弃并截断；
+// 日志不存在时从gob后端的store文件导入，便于从gob后端切换过来
+func (j *journalStore) Load() error {
+	j.Lock()
+	defer j.Unlock()
+	path := filepath.Join(j.rwDirPath, journalName)
+	f, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0666)
+	if err != nil {
+		return err
+	}
+
+	good := j.replay(f, path)
+	if err = f.Truncate(good); err == nil {
+		_, err = f.Seek(good, io.SeekStart)
+	}
+	if err != nil {
+		f.Close()
+		return err
+	}
+	j.file = f
+
+	if good == 0 {
+		if data, legacy, err := readStore(filepath.Join(j.rwDirPath, storeName)); err == nil {
+			records, cached := storeRecords(storeName, data, legacy)
+			for key, rs := range records {
+				j.overrideLocked(key, rs)
+			}
+			j.migrated = cached
+			log.Infof("import %v local records from %v into journal", len(j.data), storeName)
+			return j.compactLocked()
+		}
+	}
+	log.Infof("load %v local records from %v, %v journal records", len(j.data), journalName, j.ops)
+	if j.ops > journalCompactRatio*len(j.data) {
+		return j.compactLocked()
+	}
+	return nil
+}
+
+// replay 重放r中的变更，返回完整变更的总长度，遇到不完整或损坏的变更时停止，调用方需持有写锁
+func (j *journalStore) replay(r io.Reader, path string) int64 {
+	var good int64
+	br := bufio.NewReader(r)
+	for {
+		op, n, err := decodeJournalOp(br)
+		if err == io.EOF {
+			break
+		}
+		if err == nil {
+			err = j.apply(op)
+		}
+		if err != nil {
+			log.Warnf("journal %v: drop records after offset %v: %v", path, good, err)
+			break
+		}
+		good += n
+		j.ops++
+	}
+	return good
+}
+
+// compactLocked 把当前记录写成新的日志后替换旧日志，调用方需持有写锁
+func (j *journalStore) compactLocked() error {
+	var buf bytes.Buffer
+	for key, rs := range j.data {
+		if err := encodeJournalOp(&buf, journalOp{Op: journalOverride, Key: key, Resources: rs}); err != nil {
+			return err
+		}
+	}
+	if err := writeFileAtomic(j.rwDirPath, journalName, "", journalTmpName, buf.Bytes()); err != nil {
+		return err
+	}
+	f, err := os.OpenFile(filepath.Join(j.rwDirPath, journalName), os.O_WRONLY|os.O_APPEND, 0666)
+	if err != nil {
+		return err
+	}
+	if j.file != nil {
+		j.file.Close()
+	}
+	j.file = f
+	j.ops = len(j.data)
+	return nil
+}
@@ -0,0 +1,27 @@
+package svc
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"syscall"
+)
+
+const lockName = "lock"
+
+// LockRWDir 对rwDirPath/lock加排他锁，服务运行期间一直持有，
+// 防止import等离线命令在服务运行时覆盖同一目录下的存储。进程退出时锁自动释放
+func LockRWDir(rwDirPath string) (*os.File, error) {
+	f, err := os.OpenFile(filepath.Join(rwDirPath, lockName), os.O_RDWR|os.O_CREATE, 0666)
+	if err != nil {
+		return nil, err
+	}
+	if err := syscall.Flock(int(f.Fd()), syscall.LOCK_EX|syscall.LOCK_NB); err != nil {
+		f.Close()
+		if err == syscall.EWOULDBLOCK {
+			return nil, fmt.Errorf("%v is locked by a running server", rwDirPath)
+		}
+		return nil, err
+	}
+	return f, nil
+}
@@ -1,12 +1,12 @@
 package svc
 
 import (
-	"bufio"
 	"fmt"
 	"io/ioutil"
 	"os"
 	"os/signal"
 	"syscall"
+	"time"
 )
 
 type action func([]string) error
@@ -16,14 +16,29 @@ type Options struct {
 	aaaaHookAction action
 	aHookAction    action
 	hookAction     action
-	whitelistMap   wbmap
-	blacklistMap   wbmap
+	whitelist      *domainList //白名单，匹配的应答交给hookAction处理
+	blackLists     []string    //黑名单配置，见parseBlockList
+	listRefresh    time.Duration
+	udpSize        int //EDNS(0)通告及接受的UDP负载大小
+	forwardTimeout time.Duration
+	strategy       strategy
+	healthInterval time.Duration
+	forwardRules   []string //条件转发规则，在NewDNService中解析
+	forwardDir     string
+	zoneDir        string
+	cacheMinTTL    uint32
+	cacheMaxTTL    uint32
+	cacheEntries   int   //缓存最大条目数，0为不限制
+	cacheBytes     int64 //缓存最大占用内存，0为不限制
+	cachePolicy    evictor
+	sweepInterval  time.Duration
+	backend        Backend //本地记录的存储后端，默认为rw_path下的gob文件
 }
 
 type Option func(opts *Options)
 
 func registerSingal(fns ...func()) {
-	c := make(chan os.Signal)
+	c := make(chan os.Signal, 1)
 	signal.Notify(c, syscall.SIGUSR1)
 	go func() {
 		for {
@@ -62,47 +77,131 @@ func WithHookAction(fn action) Option {
 	}
 }
 
+// WithUDPSize 设置EDNS(0)的UDP负载大小，不设置时为1232
+func WithUDPSize(size int) Option {
+	return func(opts *Options) {
+		opts.udpSize = size
+	}
+}
+
+// WithForwardTimeout 设置等待上游应答的超时时间，超时后向client返回SERVFAIL
+func WithForwardTimeout(timeout time.Duration) Option {
+	return func(opts *Options) {
+		opts.forwardTimeout = timeout
+	}
+}
+
+// WithForwardStrategy 设置上游选择策略：failover, round_robin, random, fastest，默认failover
+func WithForwardStrategy(name string) Option {
+	return func(opts *Options) {
+		st, err := parseStrategy(name)
+		if err != nil {
+			log.Errorf("%v, use failover", err)
+		}
+		opts.strategy = st
+	}
+}
+
+// WithHealthCheck 设置上游健康检查的间隔，默认10s
+func WithHealthCheck(interval time.Duration) Option {
+	return func(opts *Options) {
+		opts.healthInterval = interval
+	}
+}
+
+// WithForwardRules 设置条件转发规则，rules为配置文件中的规则，dir为规则目录，
+// 规则格式见parseForwardRule
+func WithForwardRules(rules []string, dir string) Option {
+	return func(opts *Options) {
+		opts.forwardRules = rules
+		opts.forwardDir = dir
+	}
+}
+
+// WithZoneDir 从目录加载权威区的zone文件，收到SIGUSR1时重新加载
+func WithZoneDir(dir string) Option {
+	return func(opts *Options) {
+		opts.zoneDir = dir
+	}
+}
+
+// WithCacheTTL 设置缓存TTL的上下限，上游应答的TTL超出范围时按边界值缓存和返回，
+// max为0时不限制上限
+func WithCacheTTL(min, max uint32) Option {
+	return func(opts *Options) {
+		opts.cacheMinTTL = min
+		opts.cacheMaxTTL = max
+	}
+}
+
+// WithCacheLimit 限制缓存的条目数和占用内存(估算值)，超出时按policy淘汰：lru或lfu，默认lru。
+// 参数为0时不限制
+func WithCacheLimit(maxEntries int, maxBytes int64, policy string) Option {
+	return func(opts *Options) {
+		ev, err := newEvictor(policy)
+		if err != nil {
+			log.Errorf("%v, use lru", err)
+			ev, _ = newEvictor("lru")
+		}
+		opts.cacheEntries = maxEntries
+		opts.cacheBytes = maxBytes
+		opts.cachePolicy = ev
+	}
+}
+
+// WithCacheSweep 设置后台清理过期缓存的间隔，默认1m
+func WithCacheSweep(interval time.Duration) Option {
+	return func(opts *Options) {
+		opts.sweepInterval = interval
+	}
+}
+
+// WithBackend 设置本地记录的存储后端，见NewBackend
+func WithBackend(b Backend) Option {
+	return func(opts *Options) {
+		opts.backend = b
+	}
+}
+
+// WithBlackLists 设置黑名单，每项为"文件，目录或URL [nxdomain|refused|null|sinkhole地址] [format=格式]"，
+// 在NewDNService中加载，收到SIGUSR1时重新加载
+func WithBlackLists(lists []string) Option {
+	return func(opts *Options) {
+		opts.blackLists = append(opts.blackLists, lists...)
+	}
+}
+
+// WithSaveBList 添加一个应答NXDOMAIN的黑名单目录
 func WithSaveBList(blist string) Option {
 	return func(opts *Options) {
-		opts.blacklistMap = make(wbmap)
-		opts.blacklistMap.saveCache(blist)
-		go registerSingal(func() {
-			opts.blacklistMap.clear()
-			opts.blacklistMap.saveCache(blist)
-			fmt.Fprint(os.Stdout, fmt.Sprintf("reload blacklist_map=%+v\n", opts.blacklistMap))
-		})
-		fmt.Fprint(os.Stdout, fmt.Sprintf("blacklist_map=%+v\n", opts.blacklistMap))
+		if blist != "" {
+			opts.blackLists = append(opts.blackLists, blist)
+		}
 	}
 }
 
+// WithSaveWList 设置白名单："文件，目录或URL [format=格式]"，在NewDNService中加载，收到SIGUSR1时重新加载。
+// 与旧版本兼容，没有指定格式时单独的名称同时匹配其子域名
 func WithSaveWList(wlist string) Option {
 	return func(opts *Options) {
-		opts.whitelistMap = make(wbmap)
-		opts.whitelistMap.saveCache(wlist)
-		go registerSingal(func() {
-			opts.whitelistMap.clear()
-			opts.whitelistMap.saveCache(wlist)
-			fmt.Fprint(os.Stdout, fmt.Sprintf("reload whitelist_map=%+v\n", opts.whitelistMap))
-
-		})
-		fmt.Fprint(os.Stdout, fmt.Sprintf("white_listmap=%+v\n", opts.whitelistMap))
+		if wlist == "" {
+			return
+		}
+		opts.whitelist = &domainList{spec: wlist, widen: true}
+	}
+}
 
+// WithListRefresh 设置远程名单的更新间隔，默认6h
+func WithListRefresh(interval time.Duration) Option {
+	return func(opts *Options) {
+		opts.listRefresh = interval
 	}
 }
+
 func WithSaveBWList(blist, wlist string) Option {
 	return func(opts *Options) {
-		opts.blacklistMap = make(wbmap)
-		opts.whitelistMap = make(wbmap)
-		opts.blacklistMap.saveCache(blist)
-		opts.whitelistMap.saveCache(wlist)
-		go registerSingal(func() {
-			opts.blacklistMap.clear()
-			opts.whitelistMap.clear()
-			opts.blacklistMap.saveCache(blist)
-			opts.whitelistMap.saveCache(wlist)
-			fmt.Fprint(os.Stdout, fmt.Sprintf("reload whitelist_map=%+v, blacklist_map=%+v\n", opts.whitelistMap, opts.blacklistMap))
-		})
-		fmt.Fprint(os.Stdout, fmt.Sprintf("whitelist_map=%+v, blacklist_map=%+v\n", opts.whitelistMap, opts.blacklistMap))
+		WithSaveBList(blist)(opts)
+		WithSaveWList(wlist)(opts)
 	}
 }
 
@@ -111,12 +210,18 @@ func loadOptions(options ...Option) *Options {
 	for _, option := range options {
 		option(opts)
 	}
+	if opts.udpSize == 0 {
+		opts.udpSize = defaultUDPSize
+	} else if opts.udpSize < packetLen {
+		opts.udpSize = packetLen
+	} else if opts.udpSize > maxUDPSize {
+		opts.udpSize = maxUDPSize
+	}
 	return opts
 }
 
-type wbmap map[string]interface{}
-
-func (wb wbmap) queryFiles(folder string) (files []string) {
+// queryFiles 递归列出目录下的所有文件
+func queryFiles(folder string) (files []string) {
 	var fn func(string)
 	fn = func(fold string) {
 		elements, _ := ioutil.ReadDir(fold)
@@ -131,31 +236,3 @@ func (wb wbmap) queryFiles(folder string) (files []string) {
 	fn(folder)
 	return
 }
-func (wb wbmap) saveCache(dir string) {
-	if dir == "" {
-		return
-	}
-	files := wb.queryFiles(dir)
-	for _, file := range files {
-		f, err := os.Open(file)
-		if err != nil {
-			panic(err)
-		}
-		scanner := bufio.NewScanner(f)
-		for scanner.Scan() {
-			domain := scanner.Text()
-			if domain == "" || domain[0] == '#' || domain[0] == '[' {
-				continue
-			}
-			if len(domain) > 0 {
-				wb[domain] = struct{}{}
-			}
-		}
-	}
-}
-
-func (wb wbmap) clear() {
-	for k, _ := range wb {
-		delete(wb, k)
-	}
-}
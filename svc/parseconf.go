@@ -7,6 +7,7 @@ import (
 	"reflect"
 	"strconv"
 	"strings"
+	"time"
 	"unsafe"
 )
 
@@ -28,8 +29,33 @@ type GConf struct {
 	ForwardPort     int    `label:"forward_port"`
 	ServerPort      int    `label:"server_port"`
 
-	WhiteList string `label:"white_list"` //白名单目录
-	// BlackList string `label:"black_list"` //黑名单目录
+	EDNSUDPSize    int           `label:"edns_udp_size"`                               //EDNS(0)的UDP负载大小，默认1232
+	ForwardTimeout time.Duration `label:"forward_timeout" parse_func:"parse_duration"` //等待上游应答的超时时间，如5s
+	Forwarders     []string      `label:"forwarders" parse_func:"parse_string_list"`   //上游列表，逗号分隔，如8.8.8.8,1.1.1.1:53
+	ForwardPolicy  string        `label:"forward_strategy"`                            //failover, round_robin, random, fastest
+	HealthInterval time.Duration `label:"health_check_interval" parse_func:"parse_duration"`
+	ForwardRules   []string      `label:"forward_rule" parse_func:"parse_append"`   //条件转发规则，可配置多行
+	ForwardDir     string        `label:"forward_rules_dir"`                        //条件转发规则目录
+	ZoneDir        string        `label:"zone_dir"`                                 //权威区zone文件目录
+	CacheMinTTL    int           `label:"cache_min_ttl"`                            //缓存TTL下限(秒)
+	CacheMaxTTL    int           `label:"cache_max_ttl"`                            //缓存TTL上限(秒)，0为不限制
+	CacheEntries   int           `label:"cache_max_entries"`                        //缓存最大条目数，0为不限制
+	CacheBytes     int64         `label:"cache_max_bytes" parse_func:"parse_bytes"` //缓存最大占用内存，如64M
+	CachePolicy    string        `label:"cache_policy"`                             //缓存淘汰策略：lru, lfu
+	CacheSweep     time.Duration `label:"cache_sweep_interval" parse_func:"parse_duration"`
+	StoreBackend   string        `label:"store_backend"`                                     //本地记录的存储后端：gob, journal
+	APITokens      []string      `label:"api_token" parse_func:"parse_append"`               //REST接口的token：<token> <scopes>
+	APIUsers       []string      `label:"api_user" parse_func:"parse_append"`                //REST接口的basic认证：<user> <password> <scopes>
+	APIClientCerts []string      `label:"api_client_cert" parse_func:"parse_append"`         //允许的客户端证书：<CN> <scopes>
+	APIListen      string        `label:"api_listen"`                                        //REST接口的监听地址，默认:server_port
+	APITLSCert     string        `label:"api_tls_cert"`                                      //证书文件，配置后REST接口使用HTTPS
+	APITLSKey      string        `label:"api_tls_key"`                                       //私钥文件
+	APITLSMin      string        `label:"api_tls_min_version"`                               //最低TLS版本：1.0, 1.1, 1.2, 1.3，默认1.2
+	APIClientCA    string        `label:"api_client_ca"`                                     //验证客户端证书的CA文件
+	ListRefresh    time.Duration `label:"list_refresh_interval" parse_func:"parse_duration"` //远程名单的更新间隔
+
+	WhiteList string   `label:"white_list" parse_func:"parse_line"`   //白名单：<文件，目录或URL> [format=格式]
+	BlackList []string `label:"black_list" parse_func:"parse_append"` //黑名单：<文件，目录或URL> [nxdomain|refused|null|sinkhole地址] [format=格式]
 }
 
 //
@@ -76,7 +102,7 @@ func ParseAsBytes(value string) int64 {
 
 //ParseFile - Parse File
 func ParseFile(filePath string) {
-	fmt.Println("parsing file", filePath)
+	fmt.Fprintln(os.Stderr, "parsing file", filePath)
 
 	confile, err := os.Open(filePath)
 	if err != nil {
@@ -104,6 +130,12 @@ func ParseFile(filePath string) {
 		}
 		key = v[0]
 		value = v[1:]
+		for i, f := range value { //以//开头的字段及其后为注释，URL中的//不受影响
+			if i > 0 && strings.HasPrefix(f, "//") {
+				value = value[:i]
+				break
+			}
+		}
 
 		object := reflect.ValueOf(GConfItem)
 		myref := object.Elem()
@@ -129,10 +161,17 @@ func ParseFile(filePath string) {
 					ParseFile(value[0])
 				case "parse_bool":
 					*(*int)(unsafe.Pointer(myref.FieldByName(variableName).Addr().Pointer())) = ParseBool(value[0])
+				case "parse_line": //整行作为一个字符串
+					*(*string)(unsafe.Pointer(myref.FieldByName(variableName).Addr().Pointer())) = strings.Join(value, " ")
+				case "parse_append": //可重复出现的配置项，每行整体作为一个元素
+					field := myref.FieldByName(variableName)
+					field.Set(reflect.Append(field, reflect.ValueOf(strings.Join(value, " "))))
 				case "parse_string_list":
 					*(*[]string)(unsafe.Pointer(myref.FieldByName(variableName).Addr().Pointer())) = ParseStringList(value[0])
 				case "parse_bytes":
 					*(*int64)(unsafe.Pointer(myref.FieldByName(variableName).Addr().Pointer())) = ParseAsBytes(value[0])
+				case "parse_duration":
+					*(*time.Duration)(unsafe.Pointer(myref.FieldByName(variableName).Addr().Pointer())), _ = time.ParseDuration(value[0])
 
 				}
 
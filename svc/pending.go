@@ -0,0 +1,123 @@
+package svc
+
+import (
+	"crypto/rand"
+	"encoding/binary"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+// defaultForwardTimeout 上游在该时间内没有应答时，向等待的client返回SERVFAIL
+const defaultForwardTimeout = 5 * time.Second
+
+// questionKey 以问题(名称，类型，类)标识一个查询，名称不区分大小写
+type questionKey struct {
+	name  string
+	qtype dnsmessage.Type
+	class dnsmessage.Class
+}
+
+// pendingKey 标识一个发往上游的事务，ID由本端随机选取
+type pendingKey struct {
+	id uint16
+	questionKey
+}
+
+// pendingQuery 一个正在等待上游应答的查询，相同问题的client合并到同一个事务中，
+// 应答时按各自的原始ID回写
+type pendingQuery struct {
+	id       uint16
+	question dnsmessage.Question
+	clients  []Packet
+	timer    *time.Timer
+}
+
+type pendingTable struct {
+	sync.Mutex
+	byID       map[pendingKey]*pendingQuery
+	byQuestion map[questionKey]*pendingQuery
+	onExpire   func(*pendingQuery) //超时后调用，此时事务已从表中移除
+}
+
+func newPendingTable(onExpire func(*pendingQuery)) *pendingTable {
+	return &pendingTable{
+		byID:       make(map[pendingKey]*pendingQuery),
+		byQuestion: make(map[questionKey]*pendingQuery),
+		onExpire:   onExpire,
+	}
+}
+
+func toQuestionKey(q dnsmessage.Question) questionKey {
+	return questionKey{name: strings.ToLower(q.Name.String()), qtype: q.Type, class: q.Class}
+}
+
+// add 登记client的查询，first为true表示新建了事务，调用方需要向上游发送查询；
+// 事务在timeout后仍未应答则超时
+func (t *pendingTable) add(p Packet, timeout time.Duration) (pq *pendingQuery, first bool) {
+	q := p.message.Questions[0]
+	qk := toQuestionKey(q)
+
+	t.Lock()
+	defer t.Unlock()
+	if pq, ok := t.byQuestion[qk]; ok {
+		pq.clients = append(pq.clients, p)
+		return pq, false
+	}
+
+	pk := pendingKey{questionKey: qk}
+	for {
+		pk.id = randomID()
+		if _, ok := t.byID[pk]; !ok {
+			break
+		}
+	}
+	pq = &pendingQuery{id: pk.id, question: q, clients: []Packet{p}}
+	t.byID[pk] = pq
+	t.byQuestion[qk] = pq
+	pq.timer = time.AfterFunc(timeout, func() {
+		if t.removeIf(pk, pq) && t.onExpire != nil {
+			t.onExpire(pq)
+		}
+	})
+	return pq, true
+}
+
+// resolve 根据上游应答的ID和问题取出事务并从表中移除
+func (t *pendingTable) resolve(id uint16, q dnsmessage.Question) (*pendingQuery, bool) {
+	pk := pendingKey{id: id, questionKey: toQuestionKey(q)}
+	t.Lock()
+	pq, ok := t.byID[pk]
+	if ok {
+		t.deleteLocked(pk)
+		pq.timer.Stop()
+	}
+	t.Unlock()
+	return pq, ok
+}
+
+func (t *pendingTable) removeIf(pk pendingKey, pq *pendingQuery) bool {
+	t.Lock()
+	defer t.Unlock()
+	if t.byID[pk] != pq {
+		return false
+	}
+	t.deleteLocked(pk)
+	return true
+}
+
+func (t *pendingTable) deleteLocked(pk pendingKey) {
+	delete(t.byID, pk)
+	delete(t.byQuestion, pk.questionKey)
+}
+
+// randomID 事务ID使用密码学随机数，避免被猜测
+func randomID() uint16 {
+	var b [2]byte
+	if _, err := rand.Read(b[:]); err != nil {
+		return uint16(time.Now().UnixNano())
+	}
+	return binary.BigEndian.Uint16(b[:])
+}
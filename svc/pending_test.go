@@ -0,0 +1,72 @@
+package svc
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+// pipeClient 返回一个通过net.Pipe接收应答的client查询
+func pipeClient(id uint16, name string) (Packet, net.Conn) {
+	server, client := net.Pipe()
+	return Packet{message: testQuery(id, name), tcp: &tcpConn{conn: server, inflight: 1}}, client
+}
+
+func TestPendingResolve(t *testing.T) {
+	for _, c := range []struct {
+		name  string
+		id    func(uint16) uint16
+		qname string
+		qtype dnsmessage.Type
+		ok    bool
+	}{
+		{"match", func(id uint16) uint16 { return id }, "www.example.", dnsmessage.TypeA, true},
+		{"name case differs", func(id uint16) uint16 { return id }, "WWW.Example.", dnsmessage.TypeA, true},
+		{"id mismatch", func(id uint16) uint16 { return id + 1 }, "www.example.", dnsmessage.TypeA, false},
+		{"name mismatch", func(id uint16) uint16 { return id }, "evil.example.", dnsmessage.TypeA, false},
+		{"type mismatch", func(id uint16) uint16 { return id }, "www.example.", dnsmessage.TypeAAAA, false},
+	} {
+		memo := newPendingTable(nil)
+		p, _ := pipeClient(1, "www.example.")
+		pq, first := memo.add(p, time.Minute)
+		if !first {
+			t.Fatalf("%v: first query is not new", c.name)
+		}
+		if _, first := memo.add(p, time.Minute); first {
+			t.Errorf("%v: same question is not merged", c.name)
+		}
+		q := dnsmessage.Question{Name: dnsmessage.MustNewName(c.qname), Type: c.qtype, Class: dnsmessage.ClassINET}
+		got, ok := memo.resolve(c.id(pq.id), q)
+		if ok != c.ok || (ok && (got != pq || len(got.clients) != 2)) {
+			t.Errorf("%v: resolve got %v, want %v", c.name, ok, c.ok)
+		}
+		if _, ok := memo.resolve(pq.id, p.message.Questions[0]); ok == c.ok {
+			t.Errorf("%v: query is resolved twice or dropped by a mismatched response", c.name)
+		}
+	}
+}
+
+func TestPendingTimeout(t *testing.T) {
+	s := testRestService().Dn
+	s.memo = newPendingTable(s.fail)
+	p1, c1 := pipeClient(1, "slow.example.")
+	p2, c2 := pipeClient(2, "SLOW.example.")
+	pq, _ := s.memo.add(p1, 20*time.Millisecond)
+	s.memo.add(p2, 20*time.Millisecond)
+
+	for _, c := range []struct {
+		conn net.Conn
+		id   uint16
+	}{{c1, 1}, {c2, 2}} {
+		c.conn.SetReadDeadline(time.Now().Add(time.Second))
+		m := readMessage(t, c.conn)
+		if m.ID != c.id || m.RCode != dnsmessage.RCodeServerFailure {
+			t.Errorf("client %v: got id=%v rcode=%v, want SERVFAIL", c.id, m.ID, m.RCode)
+		}
+	}
+	if _, ok := s.memo.resolve(pq.id, pq.question); ok {
+		t.Error("expired query can still be resolved")
+	}
+}
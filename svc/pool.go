@@ -0,0 +1,220 @@
+package svc
+
+import (
+	"fmt"
+	"math/rand"
+	"net"
+	"sort"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+// strategy 上游选择策略
+type strategy int
+
+const (
+	strategyFailover   strategy = iota //按配置顺序依次尝试
+	strategyRoundRobin                 //轮流作为首选
+	strategyRandom                     //随机顺序
+	strategyFastest                    //按平滑RTT从小到大
+)
+
+const (
+	defaultHealthInterval = 10 * time.Second
+	minAttemptTimeout     = time.Second
+	maxFails              = 3 //连续失败次数达到该值时标记为down
+	srttWeight            = 8 //srtt = srtt + (rtt - srtt)/srttWeight
+)
+
+var strategyNames = map[string]strategy{
+	"failover":    strategyFailover,
+	"round_robin": strategyRoundRobin,
+	"random":      strategyRandom,
+	"fastest":     strategyFastest,
+}
+
+func parseStrategy(name string) (strategy, error) {
+	if name == "" {
+		return strategyFailover, nil
+	}
+	if st, ok := strategyNames[name]; ok {
+		return st, nil
+	}
+	return strategyFailover, fmt.Errorf("unknown forward strategy %q", name)
+}
+
+// upstreamStat 上游的健康状态，查询和健康检查都会更新
+type upstreamStat struct {
+	sync.Mutex
+	srtt  time.Duration
+	fails int
+	down  bool
+}
+
+// upstreamPool 一组上游服务器，按策略选择查询顺序，失败时依次尝试下一个
+type upstreamPool struct {
+	upstreams []*upstream
+	strategy  strategy
+	timeout   time.Duration //一次查询的总超时，平均分配给每次尝试
+	next      uint32
+}
+
+func newUpstreamPool(addrs []net.UDPAddr, st strategy, timeout time.Duration, udpSize int) *upstreamPool {
+	p := &upstreamPool{strategy: st, timeout: timeout}
+	for _, addr := range addrs {
+		p.upstreams = append(p.upstreams, newUpstream(addr, udpSize))
+	}
+	return p
+}
+
+// candidates 按策略返回本次查询的尝试顺序，down的上游排在最后作为兜底
+func (p *upstreamPool) candidates() []*upstream {
+	var up, down []*upstream
+	for _, u := range p.upstreams {
+		if u.isDown() {
+			down = append(down, u)
+		} else {
+			up = append(up, u)
+		}
+	}
+	switch p.strategy {
+	case strategyRoundRobin:
+		if len(up) > 1 {
+			i := int(atomic.AddUint32(&p.next, 1)) % len(up)
+			up = append(up[i:], up[:i]...)
+		}
+	case strategyRandom:
+		rand.Shuffle(len(up), func(i, j int) { up[i], up[j] = up[j], up[i] })
+	case strategyFastest:
+		sort.SliceStable(up, func(i, j int) bool { return up[i].rtt() < up[j].rtt() })
+	}
+	return append(up, down...)
+}
+
+// exchange 按策略依次向上游查询，返回第一个成功的应答
+func (p *upstreamPool) exchange(query dnsmessage.Message) (dnsmessage.Message, error) {
+	cands := p.candidates()
+	if len(cands) == 0 {
+		return dnsmessage.Message{}, errNoUpstream
+	}
+	deadline := time.Now().Add(p.timeout)
+	attempt := p.timeout / time.Duration(len(cands))
+	if attempt < minAttemptTimeout {
+		attempt = minAttemptTimeout
+	}
+	err := errNoUpstream
+	for _, u := range cands {
+		left := time.Until(deadline)
+		if left <= 0 {
+			break
+		}
+		if left > attempt {
+			left = attempt
+		}
+		var resp dnsmessage.Message
+		if resp, err = u.query(query, left); err == nil {
+			return resp, nil
+		}
+		log.Debugf("forward to %v error: %v", u.addr.String(), err)
+	}
+	return dnsmessage.Message{}, err
+}
+
+// healthCheck 定期向每个上游发送探测查询，连续失败的标记为down，恢复后重新启用
+func (p *upstreamPool) healthCheck(interval time.Duration) {
+	if interval <= 0 {
+		interval = defaultHealthInterval
+	}
+	probe := dnsmessage.Message{
+		Header:    dnsmessage.Header{RecursionDesired: true},
+		Questions: []dnsmessage.Question{{Name: dnsmessage.MustNewName("."), Type: dnsmessage.TypeNS, Class: dnsmessage.ClassINET}},
+	}
+	timeout := p.timeout
+	if timeout > interval {
+		timeout = interval
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for range ticker.C {
+		for _, u := range p.upstreams {
+			go func(u *upstream) {
+				q := probe
+				q.ID = randomID()
+				if _, err := u.query(q, timeout); err != nil {
+					log.Debugf("health probe to %v error: %v", u.addr.String(), err)
+				}
+			}(u)
+		}
+	}
+}
+
+// query 发送查询并记录RTT和失败次数
+func (u *upstream) query(query dnsmessage.Message, timeout time.Duration) (dnsmessage.Message, error) {
+	start := time.Now()
+	resp, err := u.exchange(query, timeout)
+	u.record(time.Since(start), err)
+	return resp, err
+}
+
+func (u *upstream) record(rtt time.Duration, err error) {
+	u.stat.Lock()
+	defer u.stat.Unlock()
+	if err != nil {
+		u.stat.fails++
+		if !u.stat.down && u.stat.fails >= maxFails {
+			u.stat.down = true
+			log.Warnf("upstream %v is down after %v failures: %v", u.addr.String(), u.stat.fails, err)
+		}
+		return
+	}
+	if u.stat.srtt == 0 {
+		u.stat.srtt = rtt
+	} else {
+		u.stat.srtt += (rtt - u.stat.srtt) / srttWeight
+	}
+	u.stat.fails = 0
+	if u.stat.down {
+		u.stat.down = false
+		log.Warnf("upstream %v is up again, rtt=%v", u.addr.String(), rtt)
+	}
+}
+
+func (u *upstream) isDown() bool {
+	u.stat.Lock()
+	defer u.stat.Unlock()
+	return u.stat.down
+}
+
+func (u *upstream) rtt() time.Duration {
+	u.stat.Lock()
+	defer u.stat.Unlock()
+	return u.stat.srtt
+}
+
+// ParseUDPAddrs 解析"ip"或"ip:port"形式的地址列表，未指定端口时使用defPort
+func ParseUDPAddrs(list []string, defPort int) ([]net.UDPAddr, error) {
+	var addrs []net.UDPAddr
+	for _, s := range list {
+		if s == "" {
+			continue
+		}
+		host, port := s, defPort
+		if h, ps, err := net.SplitHostPort(s); err == nil {
+			n, err := strconv.Atoi(ps)
+			if err != nil {
+				return nil, fmt.Errorf("invalid port in %q", s)
+			}
+			host, port = h, n
+		}
+		ip := net.ParseIP(host)
+		if ip == nil {
+			return nil, fmt.Errorf("invalid address %q", s)
+		}
+		addrs = append(addrs, net.UDPAddr{IP: ip, Port: port})
+	}
+	return addrs, nil
+}
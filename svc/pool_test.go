@@ -0,0 +1,112 @@
+package svc
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+// answeringUpstream 对每个查询返回一条A记录，关闭后端口不再监听
+func answeringUpstream(t *testing.T) (net.UDPAddr, func()) {
+	uc, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		buf := make([]byte, 512)
+		for {
+			n, from, err := uc.ReadFromUDP(buf)
+			if err != nil {
+				return
+			}
+			var q dnsmessage.Message
+			if q.Unpack(buf[:n]) != nil {
+				continue
+			}
+			m := responseTo(q)
+			r, _ := toResource(request{Host: q.Questions[0].Name.String(), TTL: 60, Type: "A", Data: "192.0.2.9"})
+			m.Answers = []dnsmessage.Resource{r}
+			packed, _ := m.Pack()
+			uc.WriteToUDP(packed, from)
+		}
+	}()
+	return *uc.LocalAddr().(*net.UDPAddr), func() { uc.Close() }
+}
+
+func TestPoolCandidates(t *testing.T) {
+	addrs := []net.UDPAddr{{IP: net.IPv4(192, 0, 2, 1)}, {IP: net.IPv4(192, 0, 2, 2)}, {IP: net.IPv4(192, 0, 2, 3)}}
+	for _, c := range []struct {
+		name     string
+		strategy strategy
+		srtt     []time.Duration
+		down     []bool
+		want     [][]int //连续几次查询的尝试顺序
+	}{
+		{name: "failover", strategy: strategyFailover, want: [][]int{{0, 1, 2}, {0, 1, 2}}},
+		{name: "failover with down", strategy: strategyFailover, down: []bool{true, false, false}, want: [][]int{{1, 2, 0}}},
+		{name: "round_robin", strategy: strategyRoundRobin, want: [][]int{{1, 2, 0}, {2, 0, 1}, {0, 1, 2}}},
+		{name: "round_robin with down", strategy: strategyRoundRobin, down: []bool{false, true, false}, want: [][]int{{2, 0, 1}, {0, 2, 1}}},
+		{name: "fastest", strategy: strategyFastest, srtt: []time.Duration{30, 10, 20}, want: [][]int{{1, 2, 0}}},
+		{name: "fastest with down", strategy: strategyFastest, srtt: []time.Duration{30, 10, 20}, down: []bool{false, true, false}, want: [][]int{{2, 0, 1}}},
+	} {
+		p := newUpstreamPool(addrs, c.strategy, time.Second, 1232)
+		index := map[*upstream]int{}
+		for i, u := range p.upstreams {
+			index[u] = i
+			if c.srtt != nil {
+				u.stat.srtt = c.srtt[i]
+			}
+			if c.down != nil {
+				u.stat.down = c.down[i]
+			}
+		}
+		for n, want := range c.want {
+			var got []int
+			for _, u := range p.candidates() {
+				got = append(got, index[u])
+			}
+			if len(got) != len(want) {
+				t.Errorf("%v #%v: got %v, want %v", c.name, n, got, want)
+				continue
+			}
+			for i := range got {
+				if got[i] != want[i] {
+					t.Errorf("%v #%v: got %v, want %v", c.name, n, got, want)
+					break
+				}
+			}
+		}
+	}
+}
+
+func TestPoolFailoverAndRecovery(t *testing.T) {
+	deadAddr, stopDead := answeringUpstream(t)
+	stopDead() //端口关闭，查询立即失败
+	liveAddr, stopLive := answeringUpstream(t)
+	defer stopLive()
+
+	p := newUpstreamPool([]net.UDPAddr{deadAddr, liveAddr}, strategyFailover, 2*time.Second, 1232)
+	dead := p.upstreams[0]
+	for i := 0; i < maxFails; i++ {
+		if _, err := p.exchange(testQuery(uint16(i), "www.example.")); err != nil {
+			t.Fatalf("query #%v did not fail over: %v", i, err)
+		}
+	}
+	if !dead.isDown() {
+		t.Fatalf("upstream is not down after %v failures", maxFails)
+	}
+	if cands := p.candidates(); cands[0] == dead {
+		t.Error("down upstream is still tried first")
+	}
+
+	//上游恢复后(这里换成可以应答的地址)，健康探测成功即重新启用
+	dead.addr = liveAddr
+	if _, err := dead.query(testQuery(100, "."), time.Second); err != nil {
+		t.Fatal(err)
+	}
+	if dead.isDown() || p.candidates()[0] != dead {
+		t.Error("recovered upstream is not preferred again")
+	}
+}
@@ -3,6 +3,8 @@ package svc
 import (
 	"encoding/json"
 	"net/http"
+
+	"golang.org/x/net/dns/dnsmessage"
 )
 
 type RestServer interface {
@@ -28,6 +30,8 @@ type request struct {
 	OldMX   requestMX
 	SRV     requestSRV
 	OldSRV  requestSRV
+	TXT     []string //每个字符串不超过255字节
+	OldTXT  []string
 }
 
 type requestSOA struct {
@@ -52,11 +56,16 @@ type requestSRV struct {
 	Target   string
 }
 
+// 记录的来源
+const (
+	sourceLocal = "local" //通过REST接口添加的本地记录
+	sourceCache = "cache" //从上游学习到的缓存
+)
+
+// get 查询结果中的一条记录，字段与request相同，可以直接作为Update和Delete的输入
 type get struct {
-	Host string
-	TTL  uint32
-	Type string
-	Data string
+	record
+	Source string
 }
 
 func (s *RestService) Create(w http.ResponseWriter, r *http.Request) {
@@ -71,8 +80,20 @@ func (s *RestService) Create(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, err.Error(), http.StatusBadRequest)
 		return
 	}
-
-	s.Dn.save(ntString(resource.Header.Name, resource.Header.Type), resource, nil)
+	if !canWrite(w, r, req.Host) {
+		return
+	}
+	err = s.Dn.book.Batch(func(tx *Tx) error {
+		if err := validateRecord(tx, resource, nil); err != nil {
+			return err
+		}
+		tx.Set(ntString(resource.Header.Name, resource.Header.Type), resource, nil)
+		return nil
+	})
+	if err != nil {
+		http.Error(w, err.Error(), validationStatus(err))
+		return
+	}
 	w.WriteHeader(http.StatusCreated)
 }
 
@@ -87,8 +108,7 @@ func (s *RestService) Update(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	oldReq := request{Host: req.Host, Type: req.Type, Data: req.OldData}
-	old, err := toResource(oldReq)
+	old, err := oldResource(req)
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusBadRequest)
 		return
@@ -99,14 +119,54 @@ func (s *RestService) Update(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, err.Error(), http.StatusBadRequest)
 		return
 	}
-
-	ok := s.Dn.save(ntString(resource.Header.Name, resource.Header.Type), resource, &old)
-	if ok {
-		w.WriteHeader(http.StatusOK)
+	if !canWrite(w, r, req.Host) {
+		return
+	}
+	err = s.Dn.book.Batch(func(tx *Tx) error {
+		if err := validateRecord(tx, resource, &old); err != nil {
+			return err
+		}
+		if !tx.Set(ntString(resource.Header.Name, resource.Header.Type), resource, &old) {
+			return errRecordNotFound
+		}
+		return nil
+	})
+	if err == errRecordNotFound {
+		http.Error(w, "", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		http.Error(w, err.Error(), validationStatus(err))
 		return
 	}
+	w.WriteHeader(http.StatusOK)
+}
 
-	http.Error(w, "", http.StatusNotFound)
+// oldResource 返回Update请求中要被替换的记录，由OldData，OldSOA，OldMX，OldSRV和OldTXT构造
+func oldResource(req request) (dnsmessage.Resource, error) {
+	return toResource(request{Host: req.Host, Type: req.Type, Data: req.OldData,
+		SOA: req.OldSOA, MX: req.OldMX, SRV: req.OldSRV, TXT: req.OldTXT})
+}
+
+// hasData 请求中是否给出了记录的数据
+func hasData(req request) bool {
+	return req.Data != "" || len(req.TXT) > 0 || req.MX.MX != "" || req.SRV.Target != "" || req.SOA.NS != ""
+}
+
+// deleteTarget 返回Delete请求的key和要删除的记录：请求中有数据时只删除该记录，否则记录为nil，删除整个RRset
+func deleteTarget(req request) (string, *dnsmessage.Resource, error) {
+	if !hasData(req) {
+		h, err := toResourceHeader(req.Host, req.Type)
+		if err != nil {
+			return "", nil, err
+		}
+		return ntString(h.Name, h.Type), nil, nil
+	}
+	r, err := toResource(req)
+	if err != nil {
+		return "", nil, err
+	}
+	return ntString(r.Header.Name, r.Header.Type), &r, nil
 }
 
 func (s *RestService) Delete(w http.ResponseWriter, r *http.Request) {
@@ -116,16 +176,24 @@ func (s *RestService) Delete(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	ok := false
-	h, err := toResourceHeader(req.Host, req.Type)
-	if err == nil {
-		ok = s.Dn.remove(ntString(h.Name, h.Type), nil)
+	key, target, err := deleteTarget(req)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if !canWrite(w, r, req.Host) {
+		return
 	}
 
-	if ok {
+	if s.Dn.remove(key, target) {
 		w.WriteHeader(http.StatusOK)
 		return
 	}
 
 	http.Error(w, "", http.StatusNotFound)
 }
+
+// Stats 返回缓存的容量，命中和淘汰计数
+func (s *RestService) Stats(w http.ResponseWriter, r *http.Request) {
+	json.NewEncoder(w).Encode(s.Dn.cache.statistics())
+}
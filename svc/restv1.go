@@ -0,0 +1,387 @@
+package svc
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+const (
+	defaultPageLimit = 100
+	maxPageLimit     = 1000
+)
+
+var (
+	errPrecondition   = errors.New("record set has been modified")
+	errRecordNotFound = errors.New("record not found")
+)
+
+// recordPage 列表查询的一页结果
+type recordPage struct {
+	Records []get
+	Total   int //过滤后的总数
+	Offset  int
+	Limit   int
+}
+
+// V1 处理/v1/下的请求：
+//
+//	GET            /v1/records                        查询所有记录
+//	GET, POST      /v1/zones/{zone}/records           查询区内的记录，在区内添加记录
+//	GET, POST, PUT, DELETE /v1/records/{name}/{type}  查询，添加，整体替换，删除一个RRset，
+//	                                                  DELETE的请求体中有记录时只删除该记录
+//	POST           /v1/batch                          原子地执行一组add，update，delete操作
+//
+// 列表支持prefix(名称前缀)，type，source(local或cache)，limit和offset参数
+func (s *RestService) V1(w http.ResponseWriter, r *http.Request) {
+	parts := strings.Split(strings.Trim(strings.TrimPrefix(r.URL.Path, "/v1/"), "/"), "/")
+	switch {
+	case len(parts) == 1 && parts[0] == "records":
+		if !allowMethod(w, r, http.MethodGet) {
+			return
+		}
+		s.listRecords(w, r, "")
+	case len(parts) == 1 && parts[0] == "batch":
+		if !allowMethod(w, r, http.MethodPost) {
+			return
+		}
+		s.batch(w, r)
+	case len(parts) == 3 && parts[0] == "zones" && parts[2] == "records":
+		zone := canonicalName(parts[1])
+		if !allowMethod(w, r, http.MethodGet, http.MethodPost) {
+			return
+		}
+		if r.Method == http.MethodGet {
+			s.listRecords(w, r, zone)
+			return
+		}
+		var req request
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if !inZone(canonicalName(req.Host), zone) {
+			http.Error(w, fmt.Sprintf("%v is not in zone %v", req.Host, zone), http.StatusBadRequest)
+			return
+		}
+		s.addRecord(w, r, req)
+	case len(parts) == 3 && parts[0] == "records":
+		if !allowMethod(w, r, http.MethodGet, http.MethodPost, http.MethodPut, http.MethodDelete) {
+			return
+		}
+		s.rrset(w, r, fqdn(parts[1]), strings.ToUpper(parts[2]))
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+func allowMethod(w http.ResponseWriter, r *http.Request, methods ...string) bool {
+	for _, m := range methods {
+		if r.Method == m {
+			return true
+		}
+	}
+	w.Header().Set("Allow", strings.Join(methods, ", "))
+	http.Error(w, "", http.StatusMethodNotAllowed)
+	return false
+}
+
+// fqdn 补全结尾的.，URL中的名称可以省略
+func fqdn(name string) string {
+	if !strings.HasSuffix(name, ".") {
+		return name + "."
+	}
+	return name
+}
+
+func (s *RestService) listRecords(w http.ResponseWriter, r *http.Request, zone string) {
+	q := r.URL.Query()
+	prefix := strings.ToLower(q.Get("prefix"))
+	rtype := strings.ToUpper(q.Get("type"))
+	source := q.Get("source")
+	limit, offset := defaultPageLimit, 0
+	var err error
+	if v := q.Get("limit"); v != "" {
+		if limit, err = strconv.Atoi(v); err != nil || limit <= 0 || limit > maxPageLimit {
+			http.Error(w, fmt.Sprintf("limit must be in [1, %v]", maxPageLimit), http.StatusBadRequest)
+			return
+		}
+	}
+	if v := q.Get("offset"); v != "" {
+		if offset, err = strconv.Atoi(v); err != nil || offset < 0 {
+			http.Error(w, "invalid offset", http.StatusBadRequest)
+			return
+		}
+	}
+
+	var recs []get
+	for _, rec := range s.Dn.all() {
+		host := strings.ToLower(rec.Host)
+		if (zone != "" && !inZone(host, zone)) || !strings.HasPrefix(host, prefix) ||
+			(rtype != "" && rec.Type != rtype) || (source != "" && rec.Source != source) {
+			continue
+		}
+		recs = append(recs, rec)
+	}
+	sortRecords(recs)
+
+	page := recordPage{Total: len(recs), Offset: offset, Limit: limit, Records: []get{}}
+	if offset < len(recs) {
+		end := offset + limit
+		if end > len(recs) {
+			end = len(recs)
+		}
+		page.Records = recs[offset:end]
+	}
+	writeJSON(w, r, http.StatusOK, page)
+}
+
+func sortRecords(recs []get) {
+	sort.SliceStable(recs, func(i, j int) bool {
+		a, b := recs[i], recs[j]
+		if a.Host != b.Host {
+			return a.Host < b.Host
+		}
+		if a.Type != b.Type {
+			return a.Type < b.Type
+		}
+		return a.Source < b.Source
+	})
+}
+
+// rrsetView 返回查询时会使用的RRset：有本地记录时为本地记录(从book读取)，否则为缓存，
+// source非空时只返回对应来源的记录
+func (s *RestService) rrsetView(book rrsetReader, key, source string) []get {
+	recs := []get{}
+	if source == "" || source == sourceLocal {
+		if rs, ok := book.Get(key); ok {
+			return appendRecords(recs, sourceLocal, rs)
+		}
+	}
+	if source == "" || source == sourceCache {
+		if e, ok := s.Dn.cache.peek(key); ok {
+			return appendRecords(recs, sourceCache, e.Resources)
+		}
+	}
+	return recs
+}
+
+func (s *RestService) rrset(w http.ResponseWriter, r *http.Request, name, rtype string) {
+	h, err := toResourceHeader(name, rtype)
+	if err != nil || h.Type == 0 || h.Type == dnsmessage.TypeOPT {
+		http.Error(w, fmt.Sprintf("invalid name or type %v %v", name, rtype), http.StatusBadRequest)
+		return
+	}
+	key := ntString(h.Name, h.Type)
+	source := r.URL.Query().Get("source")
+	if r.Method == http.MethodGet {
+		view := s.rrsetView(s.Dn.book, key, source)
+		if len(view) == 0 {
+			http.NotFound(w, r)
+			return
+		}
+		writeJSON(w, r, http.StatusOK, view)
+		return
+	}
+
+	if !canWrite(w, r, name) {
+		return
+	}
+	switch r.Method {
+	case http.MethodPost:
+		var req request
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if !fillNameType(w, &req, name, rtype) {
+			return
+		}
+		s.addRecord(w, r, req)
+	case http.MethodPut:
+		var reqs []request
+		if err := json.NewDecoder(r.Body).Decode(&reqs); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		rs := make([]dnsmessage.Resource, 0, len(reqs))
+		for _, req := range reqs {
+			if !fillNameType(w, &req, name, rtype) {
+				return
+			}
+			res, err := toResource(req)
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			rs = append(rs, res)
+		}
+		var existed bool
+		var view []get
+		err := s.Dn.book.Batch(func(tx *Tx) error {
+			if err := checkIfMatch(r, s.rrsetView(tx, key, source)); err != nil {
+				return err
+			}
+			if err := validateRRset(tx, h.Name, h.Type, rs); err != nil {
+				return err
+			}
+			_, existed = tx.Get(key)
+			tx.Override(key, rs)
+			view = s.rrsetView(tx, key, sourceLocal)
+			return nil
+		})
+		if err != nil {
+			http.Error(w, err.Error(), writeStatus(err))
+			return
+		}
+		status := http.StatusOK
+		if !existed && len(rs) > 0 {
+			status = http.StatusCreated
+		}
+		writeJSON(w, r, status, view)
+	case http.MethodDelete:
+		var req request
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil && err != io.EOF {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if !fillNameType(w, &req, name, rtype) {
+			return
+		}
+		_, target, err := deleteTarget(req)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		err = s.Dn.book.Batch(func(tx *Tx) error {
+			if err := checkIfMatch(r, s.rrsetView(tx, key, source)); err != nil {
+				return err
+			}
+			if !tx.Remove(key, target) {
+				return errRecordNotFound
+			}
+			return nil
+		})
+		if err != nil {
+			http.Error(w, err.Error(), writeStatus(err))
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
+
+// fillNameType 请求体中省略的Host和Type使用URL中的值，不一致时返回400
+func fillNameType(w http.ResponseWriter, req *request, name, rtype string) bool {
+	if req.Host == "" {
+		req.Host = name
+	}
+	if req.Type == "" {
+		req.Type = rtype
+	}
+	if fqdn(req.Host) != name || strings.ToUpper(req.Type) != rtype {
+		http.Error(w, fmt.Sprintf("record %v %v does not match url", req.Host, req.Type), http.StatusBadRequest)
+		return false
+	}
+	req.Host, req.Type = name, rtype
+	return true
+}
+
+// addRecord 向本地记录的RRset中添加一条记录，完全相同的记录已存在时返回409
+func (s *RestService) addRecord(w http.ResponseWriter, r *http.Request, req request) {
+	res, err := toResource(req)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if !canWrite(w, r, req.Host) {
+		return
+	}
+	key := ntString(res.Header.Name, res.Header.Type)
+	var view []get
+	err = s.Dn.book.Batch(func(tx *Tx) error {
+		if err := checkIfMatch(r, s.rrsetView(tx, key, r.URL.Query().Get("source"))); err != nil {
+			return err
+		}
+		if rs, _ := tx.Get(key); indexResource(rs, res) >= 0 {
+			return conflictError("record already exists")
+		}
+		if err := validateRecord(tx, res, nil); err != nil {
+			return err
+		}
+		tx.Set(key, res, nil)
+		view = s.rrsetView(tx, key, sourceLocal)
+		return nil
+	})
+	if err != nil {
+		http.Error(w, err.Error(), writeStatus(err))
+		return
+	}
+	w.Header().Set("Location", fmt.Sprintf("/v1/records/%v/%v", res.Header.Name.String(), req.Type))
+	writeJSON(w, r, http.StatusCreated, view)
+}
+
+// writeStatus 返回写入失败时的状态码
+func writeStatus(err error) int {
+	switch err {
+	case errPrecondition:
+		return http.StatusPreconditionFailed
+	case errRecordNotFound:
+		return http.StatusNotFound
+	}
+	return validationStatus(err)
+}
+
+// etag 根据应答内容生成强ETag
+func etag(body []byte) string {
+	return fmt.Sprintf(`"%x"`, sha1.Sum(body))
+}
+
+// checkIfMatch 处理If-Match，RRset在客户端读取后被修改时返回errPrecondition(412)，
+// 需要在写入的Batch中调用，保证检查和写入之间RRset不会被修改
+func checkIfMatch(r *http.Request, view []get) error {
+	match := r.Header.Get("If-Match")
+	if match == "" {
+		return nil
+	}
+	body, _ := json.Marshal(view)
+	if match == "*" && len(view) > 0 {
+		return nil
+	}
+	for _, tag := range strings.Split(match, ",") {
+		if strings.TrimSpace(tag) == etag(body) {
+			return nil
+		}
+	}
+	return errPrecondition
+}
+
+// writeJSON 写入应答并设置ETag，GET请求的If-None-Match命中时返回304
+func writeJSON(w http.ResponseWriter, r *http.Request, status int, v interface{}) {
+	body, err := json.Marshal(v)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	tag := etag(body)
+	w.Header().Set("ETag", tag)
+	if r.Method == http.MethodGet && status == http.StatusOK {
+		for _, t := range strings.Split(r.Header.Get("If-None-Match"), ",") {
+			if strings.TrimSpace(t) == tag {
+				w.WriteHeader(http.StatusNotModified)
+				return
+			}
+		}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	w.Write(append(bytes.TrimSpace(body), '\n'))
+}
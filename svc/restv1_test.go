@@ -0,0 +1,194 @@
+package svc
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+func testRestService() *RestService {
+	policy, _ := newEvictor("lru")
+	return &RestService{Dn: &DNSService{book: NewMemoryBackend(), cache: newCache(0, 0, policy), opt: &Options{}}}
+}
+
+func doV1(rest *RestService, method, url, body string, header ...string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(method, url, strings.NewReader(body))
+	for i := 0; i+1 < len(header); i += 2 {
+		req.Header.Set(header[i], header[i+1])
+	}
+	w := httptest.NewRecorder()
+	rest.V1(w, req)
+	return w
+}
+
+func TestRestV1(t *testing.T) {
+	rest := testRestService()
+	a1 := `{"TTL":600,"Data":"192.0.2.1"}`
+	if w := doV1(rest, http.MethodPost, "/v1/records/www.example.com/A", a1); w.Code != http.StatusCreated {
+		t.Fatalf("create: %v %v", w.Code, w.Body)
+	}
+	if w := doV1(rest, http.MethodPost, "/v1/records/www.example.com./a", a1); w.Code != http.StatusConflict {
+		t.Errorf("duplicate create: %v, want 409", w.Code)
+	}
+	if w := doV1(rest, http.MethodPost, "/v1/zones/example.com/records",
+		`{"Host":"mail.example.com.","TTL":600,"Type":"A","Data":"192.0.2.2"}`); w.Code != http.StatusCreated {
+		t.Errorf("create in zone: %v %v", w.Code, w.Body)
+	}
+	if w := doV1(rest, http.MethodPost, "/v1/zones/example.org/records",
+		`{"Host":"mail.example.com.","TTL":600,"Type":"A","Data":"192.0.2.2"}`); w.Code != http.StatusBadRequest {
+		t.Errorf("create out of zone: %v, want 400", w.Code)
+	}
+
+	w := doV1(rest, http.MethodGet, "/v1/records/www.example.com/A", "")
+	if w.Code != http.StatusOK || w.Header().Get("ETag") == "" {
+		t.Fatalf("get: %v %v", w.Code, w.Body)
+	}
+	tag := w.Header().Get("ETag")
+	if w := doV1(rest, http.MethodPut, "/v1/records/www.example.com/A", w.Body.String(), "If-Match", tag); w.Code != http.StatusOK || w.Header().Get("ETag") != tag {
+		t.Errorf("put back the output of get: %v %v", w.Code, w.Body)
+	}
+	if w := doV1(rest, http.MethodGet, "/v1/records/www.example.com/A", "", "If-None-Match", tag); w.Code != http.StatusNotModified {
+		t.Errorf("conditional get: %v, want 304", w.Code)
+	}
+	put := `[{"TTL":300,"Data":"192.0.2.3"},{"TTL":300,"Data":"192.0.2.4"}]`
+	if w := doV1(rest, http.MethodPut, "/v1/records/www.example.com/A", put, "If-Match", tag); w.Code != http.StatusOK {
+		t.Errorf("put: %v %v", w.Code, w.Body)
+	}
+	if w := doV1(rest, http.MethodPut, "/v1/records/www.example.com/A", put, "If-Match", tag); w.Code != http.StatusPreconditionFailed {
+		t.Errorf("put with stale etag: %v, want 412", w.Code)
+	}
+	if w := doV1(rest, http.MethodDelete, "/v1/records/www.example.com/A", "", "If-Match", tag); w.Code != http.StatusPreconditionFailed {
+		t.Errorf("delete with stale etag: %v, want 412", w.Code)
+	}
+
+	w = doV1(rest, http.MethodGet, "/v1/zones/example.com/records?type=A&limit=1&offset=1", "")
+	var page recordPage
+	if err := json.Unmarshal(w.Body.Bytes(), &page); err != nil {
+		t.Fatal(err)
+	}
+	if page.Total != 3 || len(page.Records) != 1 || page.Records[0].Host != "www.example.com." {
+		t.Errorf("unexpected page %+v", page)
+	}
+	w = doV1(rest, http.MethodGet, "/v1/records?prefix=mail&source=local", "")
+	if err := json.Unmarshal(w.Body.Bytes(), &page); err != nil || page.Total != 1 {
+		t.Errorf("prefix filter: %v", w.Body)
+	}
+
+	if w := doV1(rest, http.MethodDelete, "/v1/records/www.example.com/A", ""); w.Code != http.StatusNoContent {
+		t.Errorf("delete: %v", w.Code)
+	}
+	if w := doV1(rest, http.MethodGet, "/v1/records/www.example.com/A", ""); w.Code != http.StatusNotFound {
+		t.Errorf("get deleted: %v, want 404", w.Code)
+	}
+}
+
+func TestRestBatch(t *testing.T) {
+	rest := testRestService()
+	doV1(rest, http.MethodPost, "/v1/records/www.example.com/A", `{"TTL":600,"Data":"192.0.2.1"}`)
+	ops := `[
+		{"Op":"add","Host":"a.example.com.","TTL":600,"Type":"A","Data":"192.0.2.10"},
+		{"Op":"update","Host":"www.example.com.","TTL":600,"Type":"A","Data":"192.0.2.2","OldData":"192.0.2.1"},
+		{"Op":"delete","Host":"missing.example.com.","Type":"A"}
+	]`
+	w := doV1(rest, http.MethodPost, "/v1/batch", ops)
+	var resp batchResponse
+	if err := json.Unmarshal(w.Body.Bytes(), &resp); err != nil {
+		t.Fatal(err)
+	}
+	if w.Code != http.StatusNotFound || resp.Applied || len(resp.Results) != 3 || resp.Results[0].Status != http.StatusCreated {
+		t.Errorf("failed batch: %v %v", w.Code, w.Body)
+	}
+	if len(rest.Dn.book.Snapshot()) != 1 {
+		t.Errorf("failed batch changed the store: %v", rest.Dn.book.Snapshot())
+	}
+
+	ops = strings.Replace(ops, "missing", "a", 1)
+	if w := doV1(rest, http.MethodPost, "/v1/batch", ops); w.Code != http.StatusOK {
+		t.Fatalf("batch: %v %v", w.Code, w.Body)
+	}
+	rs, _ := rest.Dn.book.Get(ntString(dnsmessage.MustNewName("www.example.com."), dnsmessage.TypeA))
+	if len(rest.Dn.book.Snapshot()) != 1 || len(rs) != 1 || fromResource(rs[0]).Data != "192.0.2.2" {
+		t.Errorf("unexpected records after batch: %v", rest.Dn.book.Snapshot())
+	}
+}
+
+func TestRestUpdateDelete(t *testing.T) {
+	rest := testRestService()
+	do := func(h http.HandlerFunc, body string) int {
+		w := httptest.NewRecorder()
+		h(w, httptest.NewRequest(http.MethodPost, "/dns", strings.NewReader(body)))
+		return w.Code
+	}
+	mx := `{"Host":"example.com.","TTL":600,"Type":"MX","MX":{"Pref":10,"MX":"mx%v.example.com."}}`
+	do(rest.Create, fmt.Sprintf(mx, 1))
+	do(rest.Create, fmt.Sprintf(mx, 2))
+	update := `{"Host":"example.com.","TTL":600,"Type":"MX","MX":{"Pref":20,"MX":"mx3.example.com."},"OldMX":{"Pref":10,"MX":"mx1.example.com."}}`
+	if code := do(rest.Update, update); code != http.StatusOK {
+		t.Errorf("update mx: %v", code)
+	}
+	if code := do(rest.Update, update); code != http.StatusNotFound {
+		t.Errorf("update replaced mx: %v, want 404", code)
+	}
+	if code := do(rest.Delete, fmt.Sprintf(mx, 2)); code != http.StatusOK {
+		t.Errorf("delete one mx: %v", code)
+	}
+	key := ntString(dnsmessage.MustNewName("example.com."), dnsmessage.TypeMX)
+	rs, _ := rest.Dn.book.Get(key)
+	if len(rs) != 1 || fromResource(rs[0]).MX.MX != "mx3.example.com." {
+		t.Errorf("unexpected rrset %v", rs)
+	}
+
+	txt := `{"Host":"example.com.","TTL":600,"Type":"TXT","TXT":["v=spf1 -all"]}`
+	do(rest.Create, txt)
+	if code := do(rest.Update, `{"Host":"example.com.","TTL":600,"Type":"TXT","TXT":["v=spf1 mx -all"],"OldTXT":["v=spf1 -all"]}`); code != http.StatusOK {
+		t.Errorf("update txt: %v", code)
+	}
+	if code := do(rest.Delete, `{"Host":"example.com.","Type":"MX"}`); code != http.StatusOK {
+		t.Errorf("delete rrset: %v", code)
+	}
+	if _, ok := rest.Dn.book.Get(key); ok {
+		t.Error("rrset not deleted")
+	}
+}
+
+func TestAuthenticator(t *testing.T) {
+	auth, err := NewAuthenticator([]string{"t-read read", "t-zone write:example.com"}, []string{"admin secret write"}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rest := testRestService()
+	h := auth.Wrap(rest.V1)
+	body := `{"TTL":600,"Data":"192.0.2.1"}`
+	cases := []struct {
+		method, url, user, pass, token string
+		code                           int
+	}{
+		{http.MethodGet, "/v1/records", "", "", "", http.StatusUnauthorized},
+		{http.MethodGet, "/v1/records", "", "", "bad", http.StatusUnauthorized},
+		{http.MethodGet, "/v1/records", "", "", "t-read", http.StatusOK},
+		{http.MethodPost, "/v1/records/www.example.com/A", "", "", "t-read", http.StatusForbidden},
+		{http.MethodPost, "/v1/records/www.example.org/A", "", "", "t-zone", http.StatusForbidden},
+		{http.MethodPost, "/v1/records/www.example.com/A", "", "", "t-zone", http.StatusCreated},
+		{http.MethodPost, "/v1/records/www.example.org/A", "admin", "wrong", "", http.StatusUnauthorized},
+		{http.MethodPost, "/v1/records/www.example.org/A", "admin", "secret", "", http.StatusCreated},
+	}
+	for _, c := range cases {
+		req := httptest.NewRequest(c.method, c.url, strings.NewReader(body))
+		if c.token != "" {
+			req.Header.Set("Authorization", "Bearer "+c.token)
+		}
+		if c.user != "" {
+			req.SetBasicAuth(c.user, c.pass)
+		}
+		w := httptest.NewRecorder()
+		h(w, req)
+		if w.Code != c.code {
+			t.Errorf("%v %v as %v%v: got %v, want %v", c.method, c.url, c.user, c.token, w.Code, c.code)
+		}
+	}
+}
@@ -0,0 +1,140 @@
+package svc
+
+import (
+	"dns/match"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strings"
+	"sync"
+)
+
+// parseListSpec 解析名单配置"文件或目录 [选项...] [format=格式]"，返回路径，格式和其余的选项
+func parseListSpec(line string) (path, format string, fields []string, err error) {
+	for i, f := range strings.Fields(line) {
+		switch {
+		case i == 0:
+			path = f
+		case strings.HasPrefix(f, "format="):
+			format = strings.TrimPrefix(f, "format=")
+			if !match.IsFormat(format) {
+				return "", "", nil, fmt.Errorf("unknown list format %q", format)
+			}
+		default:
+			fields = append(fields, f)
+		}
+	}
+	if path == "" {
+		return "", "", nil, fmt.Errorf("empty list path")
+	}
+	return path, format, fields, nil
+}
+
+// loadRules 读取文件或目录下所有文件中的规则。format为空时按每个文件的内容判断格式，
+// 格式见match.ParseLine；无法解析的行以"文件:行号"记录日志后跳过。widen见addRules
+func loadRules(path, format string, widen bool) (*match.Matcher, error) {
+	files := []string{path}
+	if fi, err := os.Stat(path); err != nil {
+		return nil, err
+	} else if fi.IsDir() {
+		files = queryFiles(path)
+	}
+	m := match.New()
+	for _, file := range files {
+		data, err := ioutil.ReadFile(file)
+		if err != nil {
+			return nil, err
+		}
+		addRules(m, file, data, format, widen)
+	}
+	return m, nil
+}
+
+// addRules 把名为name的名单内容data中的规则加入m，返回无法解析的行数。
+// widen为true并且没有指定格式时，rules和domains格式中单独的名称同时匹配其子域名，
+// 与旧版本白名单中按正则表达式匹配的结果一致
+func addRules(m *match.Matcher, name string, data []byte, format string, widen bool) int {
+	lines := strings.Split(string(data), "\n")
+	if format == "" {
+		format = match.DetectFormat(lines)
+		widen = widen && (format == match.FormatRules || format == match.FormatDomains)
+	} else {
+		widen = false
+	}
+	before, bad := m.Len(), 0
+	for n, line := range lines {
+		rules, err := match.ParseLine(format, line)
+		for _, r := range rules {
+			if widen {
+				r = match.Widen(r)
+			}
+			if err == nil {
+				err = m.Add(r)
+			}
+		}
+		if err != nil {
+			log.Errorf("%v:%v: %v", name, n+1, err)
+			bad++
+		}
+	}
+	log.Debugf("load %v rules from %v, format %v", m.Len()-before, name, format)
+	return bad
+}
+
+// domainList 从目录加载的域名规则，重新加载时整体替换
+type domainList struct {
+	sync.RWMutex
+	spec  string //名单配置："文件，目录或URL [format=格式]"
+	widen bool   //没有指定格式时单独的名称也匹配其子域名，见addRules
+	rules *match.Matcher
+}
+
+// load 加载名单，URL由lf获取
+func (dl *domainList) load(lf *listFetcher) {
+	spec := dl.spec
+	if spec == "" {
+		return
+	}
+	path, format, fields, err := parseListSpec(spec)
+	if err == nil && len(fields) > 0 {
+		err = fmt.Errorf("unknown option %q", fields[0])
+	}
+	if err == nil {
+		path, err = lf.local(path, format)
+	}
+	if err != nil {
+		log.Errorf("list %q: %v", spec, err)
+		return
+	}
+	m, err := loadRules(path, format, dl.widen)
+	if err != nil {
+		log.Errorf("load rules from %v error: %v", path, err)
+		return
+	}
+	dl.Lock()
+	dl.rules = m
+	dl.Unlock()
+}
+
+// match 返回与name匹配的规则
+func (dl *domainList) match(name string) (string, bool) {
+	if dl == nil {
+		return "", false
+	}
+	dl.RLock()
+	m := dl.rules
+	dl.RUnlock()
+	if m == nil {
+		return "", false
+	}
+	return m.Match(name)
+}
+
+func (dl *domainList) len() int {
+	dl.RLock()
+	defer dl.RUnlock()
+	if dl.rules == nil {
+		return 0
+	}
+	return dl.rules.Len()
+}
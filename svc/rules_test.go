@@ -0,0 +1,79 @@
+package svc
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestLoadRules(t *testing.T) {
+	dir, err := ioutil.TempDir("", "rules")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	hosts := filepath.Join(dir, "hosts")
+	ioutil.WriteFile(hosts, []byte("127.0.0.1 localhost\n0.0.0.0 ads.example.com\n0.0.0.0 bad_name!\n"), 0666)
+	ioutil.WriteFile(filepath.Join(dir, "adblock"), []byte("||tracker.example.org^\n@@||ok.tracker.example.org^\n"), 0666)
+
+	var out bytes.Buffer
+	log.SetOutput(&out)
+	defer log.SetOutput(ioutil.Discard)
+	m, err := loadRules(dir, "", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(out.String(), hosts+":3:") {
+		t.Errorf("parse error not reported with file and line: %q", out.String())
+	}
+	for name, blocked := range map[string]bool{
+		"ads.example.com.":        true,
+		"www.ads.example.com.":    false,
+		"x.tracker.example.org.":  true,
+		"ok.tracker.example.org.": false,
+		"localhost.":              false,
+	} {
+		if _, ok := m.Match(name); ok != blocked {
+			t.Errorf("%v: blocked=%v, want %v", name, ok, blocked)
+		}
+	}
+
+	if _, _, _, err := parseListSpec(dir + " format=csv"); err == nil {
+		t.Error("unknown format accepted")
+	}
+	if m, err := loadRules(hosts, "domains", false); err != nil || m.Len() != 0 {
+		t.Errorf("declared format is ignored: %v rules, %v", m.Len(), err)
+	}
+}
+
+func TestWhiteListWiden(t *testing.T) {
+	dir, err := ioutil.TempDir("", "white")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	file := filepath.Join(dir, "whitelist")
+	ioutil.WriteFile(file, []byte("example.com\nexample.org.\n"), 0666)
+
+	for _, c := range []struct {
+		spec string
+		name string
+		want bool
+	}{
+		{file, "example.com.", true},
+		{file, "www.example.com.", true}, //与旧版本的正则表达式匹配一致
+		{file, "a.example.org.", true},
+		{file, "example.net.", false},
+		{file + " format=domains", "www.example.com.", false}, //指定格式时按格式匹配
+		{file + " format=domains", "example.com.", true},
+	} {
+		dl := &domainList{spec: c.spec, widen: true}
+		dl.load(nil)
+		if _, ok := dl.match(c.name); ok != c.want {
+			t.Errorf("%q %v: matched=%v, want %v", c.spec, c.name, ok, c.want)
+		}
+	}
+}
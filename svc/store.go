@@ -2,21 +2,11 @@ package svc
 
 import (
 	"encoding/gob"
-	"io"
-	"os"
-	"path/filepath"
 	"sync"
-	"time"
 
 	"golang.org/x/net/dns/dnsmessage"
 )
 
-const (
-	//域名解析后的映射关系保存至本地文件，采用gob编码，每次重启会重新加载文件值至内存
-	storeName   string = "store"
-	storeBkName string = "store_bk"
-)
-
 func init() {
 	gob.Register(&dnsmessage.AResource{})
 	gob.Register(&dnsmessage.NSResource{})
@@ -30,153 +20,220 @@ func init() {
 	gob.Register(&dnsmessage.PTRResource{})
 }
 
+// store 通过REST接口添加的本地记录，不会过期，查询时优先于上游缓存。
+// store只保存在内存中，持久化由gobStore和journalStore在其基础上实现
 type store struct {
 	sync.RWMutex
-	data      map[string]entry
-	rwDirPath string
+	data     map[string][]dnsmessage.Resource
+	migrated map[string]entry //从旧版本store文件中读出的上游应答，由DNSService放入缓存
+}
+
+func newStore() *store {
+	return &store{data: make(map[string][]dnsmessage.Resource)}
+}
+
+// takeMigrated 返回并清空Load时从旧版本store文件中读出的上游应答
+func (s *store) takeMigrated() map[string]entry {
+	s.Lock()
+	defer s.Unlock()
+	m := s.migrated
+	s.migrated = nil
+	return m
 }
 
+// entry 一个名称+类型对应的RRset，过期时间为Created+TTL，TTL取RRset中最小的TTL
 type entry struct {
 	Resources []dnsmessage.Resource
 	TTL       uint32
 	Created   int64
+	// 否定缓存(RFC 2308)：RCode为NXDOMAIN，或为NOERROR且Resources为空(NODATA)，
+	// Authorities中保存上游返回的SOA
+	RCode       dnsmessage.RCode
+	Authorities []dnsmessage.Resource
 }
 
-func (s *store) get(key string) ([]dnsmessage.Resource, bool) {
+func (e entry) expired(now int64) bool {
+	return e.Created+int64(e.TTL) <= now
+}
+
+// rrsetTTL 返回记录中最小的TTL
+func rrsetTTL(rs []dnsmessage.Resource) uint32 {
+	var ttl uint32
+	for i, r := range rs {
+		if i == 0 || r.Header.TTL < ttl {
+			ttl = r.Header.TTL
+		}
+	}
+	return ttl
+}
+
+// Get 返回的RRset不会再被修改，修改操作总是生成新的slice
+func (s *store) Get(key string) ([]dnsmessage.Resource, bool) {
 	s.RLock()
-	e, ok := s.data[key]
+	rs, ok := s.data[key]
 	s.RUnlock()
-	now := time.Now().Unix()
-	if e.TTL > 1 && (e.Created+int64(e.TTL) < now) { //判断dns缓存是否超时，如果超时直接删除
-		s.remove(key, nil)
-		return nil, false
-	}
-	return e.Resources, ok
+	return rs, ok && len(rs) > 0
 }
 
-func (s *store) set(key string, resource dnsmessage.Resource, old *dnsmessage.Resource) bool {
-	changed := false
+func (s *store) Set(key string, resource dnsmessage.Resource, old *dnsmessage.Resource) bool {
 	s.Lock()
-	if _, ok := s.data[key]; ok {
-		if old != nil {
-			for i, rec := range s.data[key].Resources {
-				if rString(rec) == rString(*old) {
-					s.data[key].Resources[i] = resource
-					changed = true
-					break
-				}
-			}
-		} else {
-			e := s.data[key]
-			e.Resources = append(e.Resources, resource)
-			s.data[key] = e
-			changed = true
-		}
-	} else {
-		e := entry{
-			Resources: []dnsmessage.Resource{resource},
-			TTL:       resource.Header.TTL,
-			Created:   time.Now().Unix(),
+	defer s.Unlock()
+	return s.setLocked(key, resource, old)
+}
+
+// setLocked 与RRset中已有的相同记录(TTL可以不同)不会重复保存，只更新TTL
+func (s *store) setLocked(key string, resource dnsmessage.Resource, old *dnsmessage.Resource) bool {
+	rs := s.data[key]
+	if old == nil {
+		s.data[key] = dedupe(append(rs[:len(rs):len(rs)], resource))
+		return true
+	}
+	for i, rec := range rs {
+		if rString(rec) == rString(*old) {
+			cp := append([]dnsmessage.Resource(nil), rs...)
+			cp[i] = resource
+			s.data[key] = dedupe(cp)
+			return true
 		}
-		s.data[key] = e
-		changed = true
 	}
-	s.Unlock()
+	return false
+}
 
-	return changed
+// dedupe 去掉rs中重复的记录，重复时保留后出现的记录并放在先出现的位置
+func dedupe(rs []dnsmessage.Resource) []dnsmessage.Resource {
+	index := make(map[string]int, len(rs))
+	out := rs[:0:0]
+	for _, r := range rs {
+		if i, ok := index[rString(r)]; ok {
+			out[i] = r
+			continue
+		}
+		index[rString(r)] = len(out)
+		out = append(out, r)
+	}
+	return out
 }
 
-func (s *store) override(key string, resources []dnsmessage.Resource) {
+func (s *store) Override(key string, rs []dnsmessage.Resource) {
 	s.Lock()
-	e := entry{
-		Resources: resources,
-		Created:   time.Now().Unix(),
-	}
-	if len(resources) > 0 {
-		e.TTL = resources[0].Header.TTL
-	}
-	s.data[key] = e
+	s.overrideLocked(key, rs)
 	s.Unlock()
 }
 
-func (s *store) remove(key string, r *dnsmessage.Resource) bool {
-	ok := false
+func (s *store) overrideLocked(key string, rs []dnsmessage.Resource) {
+	if len(rs) == 0 {
+		delete(s.data, key)
+		return
+	}
+	s.data[key] = dedupe(rs)
+}
+
+func (s *store) Remove(key string, r *dnsmessage.Resource) bool {
 	s.Lock()
+	defer s.Unlock()
+	return s.removeLocked(key, r)
+}
+
+func (s *store) removeLocked(key string, r *dnsmessage.Resource) bool {
+	rs, ok := s.data[key]
+	if !ok {
+		return false
+	}
 	if r == nil {
-		_, ok = s.data[key]
 		delete(s.data, key)
-	} else {
-		if _, ok = s.data[key]; ok {
-			for i, rec := range s.data[key].Resources {
-				if rString(rec) == rString(*r) {
-					e := s.data[key]
-					copy(e.Resources[i:], e.Resources[i+1:])
-					var blank dnsmessage.Resource
-					e.Resources[len(e.Resources)-1] = blank
-					e.Resources = e.Resources[:len(e.Resources)-1]
-					s.data[key] = e
-					ok = true
-					break
-				}
-			}
+		return true
+	}
+	for i, rec := range rs {
+		if rString(rec) == rString(*r) {
+			cp := make([]dnsmessage.Resource, 0, len(rs)-1)
+			cp = append(append(cp, rs[:i]...), rs[i+1:]...)
+			s.overrideLocked(key, cp)
+			return true
 		}
 	}
-	s.Unlock()
-	return ok
+	return false
 }
 
-func (s *store) save() {
-	bk, err := os.OpenFile(filepath.Join(s.rwDirPath, storeBkName), os.O_RDWR|os.O_CREATE, 0666)
-	if err != nil {
-		log.Errorf("err open store bak file %v", err)
-		return
-	}
-	defer bk.Close()
+func (s *store) Batch(fn func(tx *Tx) error) error {
+	s.Lock()
+	defer s.Unlock()
+	_, err := s.batchLocked(fn)
+	return err
+}
 
-	dst, err := os.OpenFile(filepath.Join(s.rwDirPath, storeName), os.O_RDWR|os.O_CREATE, 0666)
-	if err != nil {
-		log.Errorf("err open store file %v", err)
-		return
+// batchLocked 执行fn并应用修改，返回被修改的RRset(为空表示删除)，调用方需持有写锁
+func (s *store) batchLocked(fn func(tx *Tx) error) (map[string][]dnsmessage.Resource, error) {
+	tx := &Tx{base: s.data, changed: newStore(), touched: make(map[string]bool)}
+	if err := fn(tx); err != nil {
+		return nil, err
 	}
-	defer dst.Close()
-	_, err = io.Copy(bk, dst)
-	if err != nil {
-		log.Errorf("err copy store file %v", err)
-		return
+	changes := make(map[string][]dnsmessage.Resource, len(tx.touched))
+	for key := range tx.touched {
+		changes[key] = tx.changed.data[key]
+		s.overrideLocked(key, changes[key])
 	}
+	return changes, nil
+}
 
-	enc := gob.NewEncoder(dst)
-	book := s.clone()
-	if err = enc.Encode(book); err != nil {
-		//log.Fatal(err)
-		log.Error(err)
-	}
+// Tx Backend.Batch中的一组修改，方法与Backend相同，修改在fn返回前对其他调用方不可见
+type Tx struct {
+	base    map[string][]dnsmessage.Resource
+	changed *store //被修改过的key的当前RRset
+	touched map[string]bool
 }
 
-func (s *store) load() {
-	fReader, err := os.Open(filepath.Join(s.rwDirPath, storeName))
-	if err != nil {
-		log.Errorf("err load store file %v maybe first start,please ignore", err)
+// load 第一次修改key前复制其原来的RRset
+func (tx *Tx) load(key string) {
+	if tx.touched[key] {
 		return
 	}
-	defer fReader.Close()
+	tx.touched[key] = true
+	if rs, ok := tx.base[key]; ok {
+		tx.changed.data[key] = rs
+	}
+}
 
-	dec := gob.NewDecoder(fReader)
+func (tx *Tx) Get(key string) ([]dnsmessage.Resource, bool) {
+	rs, ok := tx.base[key]
+	if tx.touched[key] {
+		rs, ok = tx.changed.data[key]
+	}
+	return rs, ok && len(rs) > 0
+}
 
-	s.Lock()
-	defer s.Unlock()
+func (tx *Tx) Set(key string, r dnsmessage.Resource, old *dnsmessage.Resource) bool {
+	tx.load(key)
+	return tx.changed.setLocked(key, r, old)
+}
 
-	if err = dec.Decode(&s.data); err != nil {
-		log.Fatalf("err decode store file %v", err)
-	}
+func (tx *Tx) Override(key string, rs []dnsmessage.Resource) {
+	tx.load(key)
+	tx.changed.overrideLocked(key, rs)
 }
 
-func (s *store) clone() map[string]entry {
-	cp := make(map[string]entry)
+func (tx *Tx) Remove(key string, r *dnsmessage.Resource) bool {
+	tx.load(key)
+	return tx.changed.removeLocked(key, r)
+}
+
+func (s *store) Iterate(fn func(key string, rs []dnsmessage.Resource) bool) {
 	s.RLock()
-	for k, v := range s.data {
-		cp[k] = v
+	defer s.RUnlock()
+	for k, rs := range s.data {
+		if !fn(k, rs) {
+			return
+		}
 	}
-	s.RUnlock()
+}
+
+func (s *store) Snapshot() map[string][]dnsmessage.Resource {
+	cp := make(map[string][]dnsmessage.Resource)
+	s.Iterate(func(k string, rs []dnsmessage.Resource) bool {
+		cp[k] = rs
+		return true
+	})
 	return cp
 }
+
+func (s *store) Load() error  { return nil }
+func (s *store) Close() error { return nil }
@@ -0,0 +1,333 @@
+package svc
+
+import (
+	"bytes"
+	"encoding/gob"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+func init() {
+	log = logrus.New()
+	log.SetOutput(ioutil.Discard)
+	blog = log
+}
+
+func testRecord(t *testing.T, host, data string) (string, dnsmessage.Resource) {
+	r, err := toResource(request{Host: host, TTL: 600, Type: "A", Data: data})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return ntString(r.Header.Name, r.Header.Type), r
+}
+
+// exerciseBackend 修改b中的记录，结果由checkBackend检查
+func exerciseBackend(t *testing.T, b Backend) {
+	k1, r1 := testRecord(t, "a.example.", "192.0.2.1")
+	_, r2 := testRecord(t, "a.example.", "192.0.2.2")
+	_, r3 := testRecord(t, "a.example.", "192.0.2.3")
+	k2, r4 := testRecord(t, "b.example.", "192.0.2.4")
+
+	b.Set(k1, r1, nil)
+	b.Set(k1, r2, nil)
+	if !b.Set(k1, r3, &r2) {
+		t.Error("replace existing record failed")
+	}
+	if b.Set(k1, r3, &r4) {
+		t.Error("replace missing record should fail")
+	}
+	if err := b.Batch(func(tx *Tx) error {
+		tx.Remove(k1, nil)
+		tx.Override(k2, []dnsmessage.Resource{r4})
+		return errBatchAborted
+	}); err != errBatchAborted {
+		t.Errorf("batch returned %v", err)
+	}
+	if _, ok := b.Get(k2); ok {
+		t.Error("aborted batch has been applied")
+	}
+	b.Batch(func(tx *Tx) error {
+		tx.Override(k2, []dnsmessage.Resource{r4})
+		if _, ok := tx.Get(k2); !ok {
+			t.Error("batch does not see its own change")
+		}
+		return nil
+	})
+	if !b.Remove(k1, &r1) || b.Remove(k1, &r1) {
+		t.Error("remove single record")
+	}
+	if rs, ok := b.Get(k1); !ok || len(rs) != 1 || rString(rs[0]) != rString(r3) {
+		t.Errorf("got %v, want only %v", rs, rString(r3))
+	}
+}
+
+func checkBackend(t *testing.T, b Backend) {
+	k1, r3 := testRecord(t, "a.example.", "192.0.2.3")
+	k2, _ := testRecord(t, "b.example.", "192.0.2.4")
+	snap := b.Snapshot()
+	if len(snap) != 2 || len(snap[k1]) != 1 || rString(snap[k1][0]) != rString(r3) || len(snap[k2]) != 1 {
+		t.Errorf("unexpected snapshot %v", snap)
+	}
+}
+
+func TestMemoryBackend(t *testing.T) {
+	b := NewMemoryBackend()
+	exerciseBackend(t, b)
+	checkBackend(t, b)
+}
+
+func TestGobBackend(t *testing.T) {
+	dir, err := ioutil.TempDir("", "store")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	b := NewGobBackend(dir)
+	exerciseBackend(t, b)
+	if err := b.Close(); err != nil {
+		t.Fatal(err)
+	}
+	b.Remove(ntString(dnsmessage.MustNewName("b.example."), dnsmessage.TypeA), nil)
+	if err := b.Close(); err != nil { //上一个版本成为store_bk
+		t.Fatal(err)
+	}
+
+	ioutil.WriteFile(filepath.Join(dir, storeName), []byte(storeMagic+"garbage"), 0666)
+	b = NewGobBackend(dir)
+	b.Load()
+	checkBackend(t, b)
+	b.Close()
+
+	ioutil.WriteFile(filepath.Join(dir, storeName), []byte(storeMagic+"garbage"), 0666)
+	ioutil.WriteFile(filepath.Join(dir, storeBkName), nil, 0666)
+	b = NewGobBackend(dir)
+	defer b.Close()
+	b.Load()
+	if n := len(b.Snapshot()); n != 0 {
+		t.Errorf("got %v records from broken files, want empty store", n)
+	}
+
+	g := b.(*gobStore)
+	g.markDirty()
+	g.Close()
+	select {
+	case <-g.done:
+	default:
+		t.Error("saveLoop is still running after Close")
+	}
+}
+
+func TestGobBackendFallback(t *testing.T) {
+	dir, err := ioutil.TempDir("", "store")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	//先后保存两个版本，保存时旧的store成为store_bk，不留下临时文件
+	k1, r1 := testRecord(t, "a.example.", "192.0.2.1")
+	k2, r2 := testRecord(t, "b.example.", "192.0.2.2")
+	b := NewGobBackend(dir)
+	b.Set(k1, r1, nil)
+	b.Close()
+	v1, _ := ioutil.ReadFile(filepath.Join(dir, storeName))
+	b.Set(k2, r2, nil)
+	b.Close()
+	v2, _ := ioutil.ReadFile(filepath.Join(dir, storeName))
+	if bk, _ := ioutil.ReadFile(filepath.Join(dir, storeBkName)); !bytes.Equal(bk, v1) {
+		t.Error("store_bk is not the previous store")
+	}
+	if _, err := os.Stat(filepath.Join(dir, storeTmpName)); !os.IsNotExist(err) {
+		t.Errorf("%v is left after save: %v", storeTmpName, err)
+	}
+
+	for _, c := range []struct {
+		name  string
+		store []byte //nil表示删除
+		bk    []byte
+		tmp   []byte
+		want  int
+	}{
+		{"intact", v2, v1, nil, 2},
+		{"crash before rename", v2, v1, []byte(storeMagic + "half"), 2},
+		{"missing store", nil, v1, nil, 1},
+		{"corrupt store", []byte(storeMagic + "\x00\x01garbage"), v1, nil, 1},
+		{"truncated header", []byte(storeMagic), v1, nil, 1},
+		{"unknown version", append([]byte(storeMagic+"\x00\x09"), v2[len(storeMagic)+2:]...), v1, nil, 1},
+		{"both corrupt", []byte(storeMagic + "garbage"), []byte{}, nil, 0},
+		{"none", nil, nil, nil, 0},
+	} {
+		for file, data := range map[string][]byte{storeName: c.store, storeBkName: c.bk, storeTmpName: c.tmp} {
+			os.Remove(filepath.Join(dir, file))
+			if data != nil {
+				ioutil.WriteFile(filepath.Join(dir, file), data, 0666)
+			}
+		}
+		b := NewGobBackend(dir)
+		b.Load()
+		if n := len(b.Snapshot()); n != c.want {
+			t.Errorf("%v: got %v records, want %v", c.name, n, c.want)
+		}
+		b.Close()
+	}
+}
+
+func TestGobBackendLegacy(t *testing.T) {
+	//旧版本没有文件头，本地记录(TTL不大于1)与过期或未过期的上游应答混在一起
+	now := time.Now().Unix()
+	k1, r1 := testRecord(t, "local.example.", "192.0.2.1")
+	k2, r2 := testRecord(t, "expired.example.", "192.0.2.2")
+	k3, r3 := testRecord(t, "fresh.example.", "192.0.2.3")
+	k4, _ := testRecord(t, "nodata.example.", "192.0.2.4")
+	k5, r5 := testRecord(t, "one.example.", "192.0.2.5")
+	data := map[string]entry{
+		k1: {Resources: []dnsmessage.Resource{r1}, TTL: 0, Created: now - 3600},
+		k2: {Resources: []dnsmessage.Resource{r2}, TTL: 600, Created: now - 3600},
+		k3: {Resources: []dnsmessage.Resource{r3}, TTL: 600, Created: now},
+		k4: {TTL: 600, Created: now},
+		k5: {Resources: []dnsmessage.Resource{r5}, TTL: 1, Created: now - 3600},
+	}
+	var buf bytes.Buffer
+	if err := gob.NewEncoder(&buf).Encode(data); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, c := range []struct {
+		backend string
+		new     func(dir string) Backend
+	}{
+		{BackendGob, NewGobBackend},
+		{BackendJournal, NewJournalBackend}, //日志不存在时从store导入
+	} {
+		dir, err := ioutil.TempDir("", "store")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer os.RemoveAll(dir)
+		ioutil.WriteFile(filepath.Join(dir, storeName), buf.Bytes(), 0666)
+
+		b := c.new(dir)
+		b.Load()
+		snap := b.Snapshot()
+		if len(snap) != 2 || snap[k1] == nil || snap[k5] == nil {
+			t.Errorf("%v: got local records %v, want only %v and %v", c.backend, snap, k1, k5)
+		}
+		cached := b.(migrator).takeMigrated()
+		if len(cached) != 1 || cached[k3].Created != now {
+			t.Errorf("%v: got cached answers %v, want only %v", c.backend, cached, k3)
+		}
+		if len(b.(migrator).takeMigrated()) != 0 {
+			t.Errorf("%v: migrated answers are returned twice", c.backend)
+		}
+		b.Close()
+	}
+}
+
+func TestJournalBackend(t *testing.T) {
+	dir, err := ioutil.TempDir("", "journal")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	b := NewJournalBackend(dir)
+	if err := b.Load(); err != nil {
+		t.Fatal(err)
+	}
+	exerciseBackend(t, b)
+	b.Close()
+
+	f, _ := os.OpenFile(filepath.Join(dir, journalName), os.O_WRONLY|os.O_APPEND, 0666)
+	f.Write([]byte{0, 0, 1, 0, 1, 2}) //崩溃时写了一半的记录
+	f.Close()
+
+	b = NewJournalBackend(dir)
+	if err := b.Load(); err != nil {
+		t.Fatal(err)
+	}
+	checkBackend(t, b)
+	k, r := testRecord(t, "c.example.", "192.0.2.5")
+	b.Set(k, r, nil)
+	b.Close()
+
+	b = NewJournalBackend(dir)
+	if err := b.Load(); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := b.Get(k); !ok || len(b.Snapshot()) != 3 {
+		t.Errorf("record appended after a torn write is lost: %v", b.Snapshot())
+	}
+}
+
+func TestDecodeJournalOp(t *testing.T) {
+	var good bytes.Buffer
+	encodeJournalOp(&good, journalOp{Op: journalRemove, Key: "k"})
+	corrupt := append([]byte(nil), good.Bytes()...)
+	corrupt[len(corrupt)-1] ^= 0xff
+	for _, c := range []struct {
+		name string
+		data []byte
+		ok   bool
+	}{
+		{"valid", good.Bytes(), true},
+		{"torn header", good.Bytes()[:5], false},
+		{"torn payload", good.Bytes()[:good.Len()-1], false},
+		{"checksum mismatch", corrupt, false},
+		{"oversized length", []byte{0xff, 0xff, 0xff, 0xff, 0, 0, 0, 0}, false},
+	} {
+		op, n, err := decodeJournalOp(bytes.NewReader(c.data))
+		if c.ok != (err == nil) || err == io.EOF {
+			t.Errorf("%v: got error %v", c.name, err)
+			continue
+		}
+		if c.ok && (op.Key != "k" || n != int64(len(c.data))) {
+			t.Errorf("%v: got %+v, %v bytes", c.name, op, n)
+		}
+	}
+}
+
+func TestReadRecords(t *testing.T) {
+	for _, c := range []struct {
+		backend string
+		file    string
+		new     func(dir string) Backend
+	}{
+		{BackendGob, storeName, NewGobBackend},
+		{BackendJournal, journalName, NewJournalBackend},
+	} {
+		dir, err := ioutil.TempDir("", "read")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer os.RemoveAll(dir)
+
+		b := c.new(dir)
+		b.Load()
+		exerciseBackend(t, b)
+		b.Close()
+		file := filepath.Join(dir, c.file)
+		if c.backend == BackendJournal { //服务正在写入的记录，只读加载时不能被截断
+			f, _ := os.OpenFile(file, os.O_WRONLY|os.O_APPEND, 0666)
+			f.Write([]byte{0, 0, 1, 0, 1, 2})
+			f.Close()
+		}
+		before, _ := ioutil.ReadFile(file)
+
+		r, err := ReadRecords(c.backend, dir)
+		if err != nil {
+			t.Fatalf("%v: %v", c.backend, err)
+		}
+		checkBackend(t, r)
+		if after, _ := ioutil.ReadFile(file); !bytes.Equal(before, after) {
+			t.Errorf("%v: ReadRecords modified %v", c.backend, c.file)
+		}
+	}
+}
@@ -0,0 +1,231 @@
+package svc
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"dns/match"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	listDirName        = "lists" //rw_path下保存远程名单的目录
+	defaultListRefresh = 6 * time.Hour
+	listFetchTimeout   = 30 * time.Second
+	maxListSize        = 64 << 20
+	listMetaSuffix     = ".meta"
+	listTmpSuffix      = ".tmp"
+)
+
+// subscription 一个远程名单，file为最后一次成功解析的内容
+type subscription struct {
+	sync.Mutex
+	url    string
+	format string
+	file   string
+	meta   listMeta
+}
+
+// listMeta 与名单内容一起保存，用于条件请求
+type listMeta struct {
+	ETag         string
+	LastModified string
+}
+
+// listFetcher 定期获取file://和http(s)://名单，内容解析成功后才替换rw_path/lists下的副本，
+// 获取或解析失败时继续使用上一次成功的副本
+type listFetcher struct {
+	sync.Mutex
+	dir      string
+	interval time.Duration
+	client   *http.Client
+	subs     map[string]*subscription
+}
+
+func newListFetcher(dir string, interval time.Duration) *listFetcher {
+	if interval <= 0 {
+		interval = defaultListRefresh
+	}
+	return &listFetcher{
+		dir:      dir,
+		interval: interval,
+		client:   &http.Client{Timeout: listFetchTimeout},
+		subs:     make(map[string]*subscription),
+	}
+}
+
+// isListURL path是否为远程名单
+func isListURL(path string) bool {
+	return strings.HasPrefix(path, "file://") || strings.HasPrefix(path, "http://") || strings.HasPrefix(path, "https://")
+}
+
+// local 返回名单在本地的路径：普通路径原样返回；URL返回保存的副本，第一次使用且没有副本时立即获取
+func (lf *listFetcher) local(path, format string) (string, error) {
+	if lf == nil || !isListURL(path) {
+		return path, nil
+	}
+	lf.Lock()
+	sub, ok := lf.subs[path]
+	if !ok {
+		name := fmt.Sprintf("%x", sha1.Sum([]byte(path)))
+		sub = &subscription{url: path, format: format, file: filepath.Join(lf.dir, name)}
+		if data, err := ioutil.ReadFile(sub.file + listMetaSuffix); err == nil {
+			json.Unmarshal(data, &sub.meta)
+		}
+		lf.subs[path] = sub
+	}
+	lf.Unlock()
+	if _, err := os.Stat(sub.file); err == nil {
+		return sub.file, nil
+	}
+	if _, err := lf.fetch(sub); err != nil {
+		return "", fmt.Errorf("fetch %v: %v", path, err)
+	}
+	return sub.file, nil
+}
+
+// run 启动时和之后每隔interval获取一次所有名单，有名单更新时调用reload。
+// 启动时使用的可能是很久之前保存的副本，所以立即检查一次
+func (lf *listFetcher) run(reload func()) {
+	ticker := time.NewTicker(lf.interval)
+	defer ticker.Stop()
+	for {
+		if lf.refresh() {
+			reload()
+		}
+		<-ticker.C
+	}
+}
+
+// refresh 获取所有名单，返回是否有名单更新
+func (lf *listFetcher) refresh() bool {
+	lf.Lock()
+	subs := make([]*subscription, 0, len(lf.subs))
+	for _, sub := range lf.subs {
+		subs = append(subs, sub)
+	}
+	lf.Unlock()
+	changed := false
+	for _, sub := range subs {
+		ok, err := lf.fetch(sub)
+		if err != nil {
+			log.Errorf("fetch list %v error: %v, keep the last good copy", sub.url, err)
+			continue
+		}
+		changed = changed || ok
+	}
+	return changed
+}
+
+// fetch 获取名单，内容有变化并且解析成功时保存，返回是否更新了保存的副本
+func (lf *listFetcher) fetch(sub *subscription) (bool, error) {
+	sub.Lock()
+	defer sub.Unlock()
+	data, meta, err := lf.download(sub)
+	if err != nil {
+		return false, err
+	}
+	if data == nil {
+		lf.saveMeta(sub, meta)
+		return false, nil
+	}
+	if old, err := ioutil.ReadFile(sub.file); err == nil && bytes.Equal(old, data) {
+		lf.saveMeta(sub, meta)
+		return false, nil
+	}
+	head := bytes.ToLower(bytes.TrimSpace(data))
+	if bytes.HasPrefix(head, []byte("<!doctype")) || bytes.HasPrefix(head, []byte("<html")) {
+		return false, fmt.Errorf("got an HTML page instead of a list")
+	}
+	m := match.New()
+	bad := addRules(m, sub.url, data, sub.format, false)
+	if m.Len() == 0 {
+		return false, fmt.Errorf("no valid rules, %v bad lines", bad)
+	}
+
+	if err := os.MkdirAll(lf.dir, 0755); err != nil {
+		return false, err
+	}
+	name := filepath.Base(sub.file)
+	if err := writeFileAtomic(lf.dir, name, "", name+listTmpSuffix, data); err != nil {
+		return false, err
+	}
+	lf.saveMeta(sub, meta)
+	log.Infof("update list %v, %v rules", sub.url, m.Len())
+	return true, nil
+}
+
+// saveMeta 更新并保存条件请求使用的ETag和Last-Modified，没有变化时不写文件，调用方需持有sub的锁
+func (lf *listFetcher) saveMeta(sub *subscription, meta listMeta) {
+	if meta == sub.meta {
+		return
+	}
+	sub.meta = meta
+	name := filepath.Base(sub.file) + listMetaSuffix
+	b, _ := json.Marshal(meta)
+	if err := writeFileAtomic(lf.dir, name, "", name+listTmpSuffix, b); err != nil {
+		log.Errorf("save list meta %v error: %v", sub.url, err)
+	}
+}
+
+// download 下载名单，内容没有变化(304)时返回nil
+func (lf *listFetcher) download(sub *subscription) ([]byte, listMeta, error) {
+	u, err := url.Parse(sub.url)
+	if err != nil {
+		return nil, listMeta{}, err
+	}
+	if u.Scheme == "file" {
+		data, err := ioutil.ReadFile(u.Path)
+		return data, listMeta{}, err
+	}
+
+	req, err := http.NewRequest(http.MethodGet, sub.url, nil)
+	if err != nil {
+		return nil, listMeta{}, err
+	}
+	req.Header.Set("User-Agent", "dns-server")
+	if _, err := os.Stat(sub.file); err == nil { //没有副本时不能使用条件请求
+		if sub.meta.ETag != "" {
+			req.Header.Set("If-None-Match", sub.meta.ETag)
+		}
+		if sub.meta.LastModified != "" {
+			req.Header.Set("If-Modified-Since", sub.meta.LastModified)
+		}
+	}
+	resp, err := lf.client.Do(req)
+	if err != nil {
+		return nil, listMeta{}, err
+	}
+	defer resp.Body.Close()
+	switch resp.StatusCode {
+	case http.StatusNotModified: //304中可能带有新的ETag或Last-Modified
+		meta := sub.meta
+		if etag := resp.Header.Get("ETag"); etag != "" {
+			meta.ETag = etag
+		}
+		if lm := resp.Header.Get("Last-Modified"); lm != "" {
+			meta.LastModified = lm
+		}
+		return nil, meta, nil
+	case http.StatusOK:
+	default:
+		return nil, listMeta{}, fmt.Errorf("unexpected status %v", resp.Status)
+	}
+	data, err := ioutil.ReadAll(io.LimitReader(resp.Body, maxListSize+1))
+	if err != nil {
+		return nil, listMeta{}, err
+	}
+	if len(data) > maxListSize {
+		return nil, listMeta{}, fmt.Errorf("list larger than %v bytes", maxListSize)
+	}
+	return data, listMeta{ETag: resp.Header.Get("ETag"), LastModified: resp.Header.Get("Last-Modified")}, nil
+}
@@ -0,0 +1,107 @@
+package svc
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestListFetcher(t *testing.T) {
+	dir, err := ioutil.TempDir("", "lists")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	body, status, notModified, newTag := "||ads.example.com^\n", http.StatusOK, 0, ""
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("If-None-Match") == `"v1"` && body == "||ads.example.com^\n" {
+			notModified++
+			if newTag != "" {
+				w.Header().Set("ETag", newTag)
+			}
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+		w.Header().Set("ETag", `"v1"`)
+		w.WriteHeader(status)
+		w.Write([]byte(body))
+	}))
+	defer srv.Close()
+
+	lf := newListFetcher(filepath.Join(dir, listDirName), 0)
+	path, err := lf.local(srv.URL+"/ads.txt", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	check := func(name string, blocked bool) {
+		t.Helper()
+		m, err := loadRules(path, "", false)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, ok := m.Match(name); ok != blocked {
+			t.Errorf("%v: blocked=%v, want %v", name, ok, blocked)
+		}
+	}
+	check("ads.example.com.", true)
+
+	if lf.refresh() || notModified != 1 {
+		t.Errorf("unchanged list: notModified=%v", notModified)
+	}
+	checkMeta := func(etag string) {
+		t.Helper()
+		var meta listMeta
+		data, _ := ioutil.ReadFile(path + listMetaSuffix)
+		if err := json.Unmarshal(data, &meta); err != nil || meta.ETag != etag {
+			t.Errorf("saved etag %q, want %q", meta.ETag, etag)
+		}
+	}
+	newTag = `"v2"` //304中的新ETag需要保存
+	if lf.refresh() || notModified != 2 {
+		t.Errorf("unchanged list: notModified=%v", notModified)
+	}
+	checkMeta(`"v2"`)
+	newTag = "" //ETag不匹配时返回相同的内容
+	if lf.refresh() {
+		t.Error("unchanged body reported as update")
+	}
+	checkMeta(`"v1"`)
+	body = "<html>maintenance</html>"
+	if lf.refresh() {
+		t.Error("html page accepted")
+	}
+	body, status = "", http.StatusInternalServerError
+	if lf.refresh() {
+		t.Error("failed fetch accepted")
+	}
+	check("ads.example.com.", true)
+
+	body, status = "0.0.0.0 tracker.example.org\n", http.StatusOK
+	if !lf.refresh() {
+		t.Error("new list not fetched")
+	}
+	check("tracker.example.org.", true)
+	check("ads.example.com.", false)
+
+	srv.Close() //重启后使用保存的副本
+	lf = newListFetcher(filepath.Join(dir, listDirName), 0)
+	if path, err = lf.local(srv.URL+"/ads.txt", ""); err != nil {
+		t.Fatal(err)
+	}
+	check("tracker.example.org.", true)
+
+	local := filepath.Join(dir, "local.txt")
+	ioutil.WriteFile(local, []byte("address=/dnsmasq.example.net/\n"), 0666)
+	if path, err = lf.local("file://"+local, ""); err != nil {
+		t.Fatal(err)
+	}
+	check("www.dnsmasq.example.net.", true)
+	if _, err := lf.local("file://"+filepath.Join(dir, "missing"), ""); err == nil {
+		t.Error("missing file:// list accepted")
+	}
+}
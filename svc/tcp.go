@@ -0,0 +1,200 @@
+package svc
+
+import (
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"sync"
+	"time"
+
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+const (
+	tcpPort        int = 53
+	tcpDialTimeout     = 3 * time.Second
+	tcpIOTimeout       = 5 * time.Second
+	maxTCPConns        = 1000 //同时处理的TCP连接数，超出时新连接直接关闭
+	maxTCPInflight     = 64   //单个连接上未应答的查询数，超出时断开该连接
+)
+
+// tcpIdleTimeout 连接空闲超时时间，超时后等待未完成的查询应答后关闭
+var tcpIdleTimeout = 10 * time.Second
+
+var errIDMismatch = errors.New("response id mismatch")
+
+// tcpConn 客户端的一条TCP连接，同一连接上可以流水线式发送多个查询，
+// 查询并发处理，写回应答时加锁保证长度前缀与报文不被交错
+type tcpConn struct {
+	sync.Mutex
+	conn     net.Conn
+	inflight int  //已读取但还未应答的查询数
+	closing  bool //读端已结束，等待inflight归零后关闭
+	closed   bool
+	release  func() //连接关闭后释放listenTCP中占用的名额
+}
+
+func (s *DNSService) listenTCP() {
+	ln, err := net.ListenTCP("tcp", &net.TCPAddr{Port: tcpPort})
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer ln.Close()
+
+	sem := make(chan struct{}, maxTCPConns)
+	for {
+		conn, err := ln.AcceptTCP()
+		if err != nil {
+			log.Error(err)
+			continue
+		}
+		select {
+		case sem <- struct{}{}:
+		default:
+			log.Warnf("too many tcp connections, drop %v", conn.RemoteAddr())
+			conn.Close()
+			continue
+		}
+		go s.serveTCP(conn, func() { <-sem })
+	}
+}
+
+func (s *DNSService) serveTCP(conn *net.TCPConn, release func()) {
+	c := &tcpConn{conn: conn, release: release}
+	tcpAddr := conn.RemoteAddr().(*net.TCPAddr)
+	addr := net.UDPAddr{IP: tcpAddr.IP, Port: tcpAddr.Port, Zone: tcpAddr.Zone}
+	for {
+		conn.SetReadDeadline(time.Now().Add(tcpIdleTimeout))
+		buf, err := readFrame(conn)
+		if err != nil {
+			if err != io.EOF {
+				log.Debugf("tcp read from %v: %v", addr.String(), err)
+			}
+			break
+		}
+		var m dnsmessage.Message
+		if err = m.Unpack(buf); err != nil {
+			log.Error(err)
+			break
+		}
+		if len(m.Questions) == 0 || m.Response {
+			continue
+		}
+		c.Lock()
+		full := c.inflight >= maxTCPInflight
+		if !full {
+			c.inflight++
+		}
+		c.Unlock()
+		if full {
+			log.Warnf("too many tcp queries in flight from %v, drop the connection", addr.String())
+			break
+		}
+		go s.Query(Packet{addr: addr, message: m, tcp: c})
+	}
+	c.shutdown()
+}
+
+// shutdown 读端结束后调用，若仍有查询未应答则最多再等待tcpIdleTimeout
+func (c *tcpConn) shutdown() {
+	c.Lock()
+	defer c.Unlock()
+	c.closing = true
+	if c.inflight == 0 {
+		c.closeLocked()
+		return
+	}
+	time.AfterFunc(tcpIdleTimeout, func() {
+		c.Lock()
+		c.closeLocked()
+		c.Unlock()
+	})
+}
+
+// closeLocked 关闭连接并释放名额，可以重复调用，调用方需持有锁
+func (c *tcpConn) closeLocked() {
+	if c.closed {
+		return
+	}
+	c.closed = true
+	c.conn.Close()
+	if c.release != nil {
+		c.release()
+	}
+}
+
+func (c *tcpConn) write(message dnsmessage.Message) {
+	packed, err := message.Pack()
+	if err != nil {
+		log.Println(err)
+		return
+	}
+
+	c.Lock()
+	defer c.Unlock()
+	if c.inflight > 0 {
+		c.inflight--
+	}
+	if c.closed {
+		return
+	}
+	c.conn.SetWriteDeadline(time.Now().Add(tcpIOTimeout))
+	if err = writeFrame(c.conn, packed); err != nil {
+		log.Debugf("tcp write to %v: %v", c.conn.RemoteAddr(), err)
+	}
+	if c.closing && c.inflight == 0 {
+		c.closeLocked()
+	}
+}
+
+// readFrame 按RFC 1035 4.2.2读取两字节长度前缀的报文
+func readFrame(r io.Reader) ([]byte, error) {
+	var l [2]byte
+	if _, err := io.ReadFull(r, l[:]); err != nil {
+		return nil, err
+	}
+	buf := make([]byte, binary.BigEndian.Uint16(l[:]))
+	if _, err := io.ReadFull(r, buf); err != nil {
+		return nil, err
+	}
+	return buf, nil
+}
+
+func writeFrame(w io.Writer, packed []byte) error {
+	buf := make([]byte, 2+len(packed))
+	binary.BigEndian.PutUint16(buf, uint16(len(packed)))
+	copy(buf[2:], packed)
+	_, err := w.Write(buf)
+	return err
+}
+
+// exchangeTCP 通过TCP向上游发送查询并等待应答，用于UDP应答被截断(TC)时重试
+func exchangeTCP(addr net.UDPAddr, query dnsmessage.Message) (dnsmessage.Message, error) {
+	var resp dnsmessage.Message
+	packed, err := query.Pack()
+	if err != nil {
+		return resp, err
+	}
+	conn, err := net.DialTimeout("tcp", addr.String(), tcpDialTimeout)
+	if err != nil {
+		return resp, err
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(tcpIOTimeout))
+
+	if err = writeFrame(conn, packed); err != nil {
+		return resp, err
+	}
+	buf, err := readFrame(conn)
+	if err != nil {
+		return resp, err
+	}
+	if err = resp.Unpack(buf); err != nil {
+		return resp, err
+	}
+	if resp.ID != query.ID {
+		return resp, errIDMismatch
+	}
+	return resp, nil
+}
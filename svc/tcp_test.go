@@ -0,0 +1,169 @@
+package svc
+
+import (
+	"bytes"
+	"net"
+	"testing"
+	"time"
+
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+func testQuery(id uint16, name string) dnsmessage.Message {
+	return dnsmessage.Message{
+		Header:    dnsmessage.Header{ID: id, RecursionDesired: true},
+		Questions: []dnsmessage.Question{{Name: dnsmessage.MustNewName(name), Type: dnsmessage.TypeA, Class: dnsmessage.ClassINET}},
+	}
+}
+
+func packFrame(t *testing.T, m dnsmessage.Message) []byte {
+	packed, err := m.Pack()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var buf bytes.Buffer
+	writeFrame(&buf, packed)
+	return buf.Bytes()
+}
+
+func readMessage(t *testing.T, conn net.Conn) dnsmessage.Message {
+	var m dnsmessage.Message
+	buf, err := readFrame(conn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = m.Unpack(buf); err != nil {
+		t.Fatal(err)
+	}
+	return m
+}
+
+func TestServeTCP(t *testing.T) {
+	defer func(d time.Duration) { tcpIdleTimeout = d }(tcpIdleTimeout)
+	tcpIdleTimeout = 200 * time.Millisecond
+
+	s := testRestService().Dn
+	k, r := testRecord(t, "www.example.", "192.0.2.1")
+	s.book.Set(k, r, nil)
+
+	ln, err := net.ListenTCP("tcp", &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	client, err := net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	conn, err := ln.AcceptTCP()
+	if err != nil {
+		t.Fatal(err)
+	}
+	released := make(chan struct{})
+	go s.serveTCP(conn, func() { close(released) })
+
+	//两个查询在同一次写入中流水线发送，第二个的长度前缀拆成两次写入
+	first := packFrame(t, testQuery(1, "www.example."))
+	second := packFrame(t, testQuery(2, "www.example."))
+	client.Write(append(first, second[:1]...))
+	time.Sleep(10 * time.Millisecond)
+	client.Write(second[1:])
+	client.SetReadDeadline(time.Now().Add(time.Second))
+	ids := map[uint16]bool{}
+	for i := 0; i < 2; i++ {
+		m := readMessage(t, client)
+		if !m.Response || len(m.Answers) != 1 || rString(m.Answers[0]) != rString(r) {
+			t.Errorf("unexpected response %+v", m)
+		}
+		ids[m.ID] = true
+	}
+	if !ids[1] || !ids[2] {
+		t.Errorf("got responses %v, want ids 1 and 2", ids)
+	}
+
+	//空闲超时后服务端关闭连接并释放名额
+	select {
+	case <-released:
+	case <-time.After(5 * tcpIdleTimeout):
+		t.Fatal("idle connection is not closed")
+	}
+	if _, err := readFrame(client); err == nil {
+		t.Error("read from an idle-closed connection succeeded")
+	}
+}
+
+// fakeUpstream 在同一端口上监听UDP和TCP，UDP应答总是被截断，TCP应答的ID由tcpID决定
+func fakeUpstream(t *testing.T, tcpID func(uint16) uint16) (net.UDPAddr, func()) {
+	uc, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := *uc.LocalAddr().(*net.UDPAddr)
+	ln, err := net.ListenTCP("tcp", &net.TCPAddr{IP: addr.IP, Port: addr.Port})
+	if err != nil {
+		uc.Close()
+		t.Skipf("tcp port %v is in use: %v", addr.Port, err)
+	}
+	answer := func(q dnsmessage.Message, truncated bool) []byte {
+		m := responseTo(q)
+		m.Truncated = truncated
+		if !truncated {
+			_, r := testRecord(t, q.Questions[0].Name.String(), "192.0.2.9")
+			m.Answers = []dnsmessage.Resource{r}
+		}
+		packed, _ := m.Pack()
+		return packed
+	}
+	go func() {
+		buf := make([]byte, 512)
+		for {
+			n, from, err := uc.ReadFromUDP(buf)
+			if err != nil {
+				return
+			}
+			var q dnsmessage.Message
+			if q.Unpack(buf[:n]) == nil {
+				uc.WriteToUDP(answer(q, true), from)
+			}
+		}
+	}()
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			buf, err := readFrame(conn)
+			var q dnsmessage.Message
+			if err == nil && q.Unpack(buf) == nil {
+				q.ID = tcpID(q.ID)
+				writeFrame(conn, answer(q, false))
+			}
+			conn.Close()
+		}
+	}()
+	return addr, func() { uc.Close(); ln.Close() }
+}
+
+func TestExchangeTruncated(t *testing.T) {
+	for _, c := range []struct {
+		name  string
+		tcpID func(uint16) uint16
+		err   error
+	}{
+		{"retry over tcp", func(id uint16) uint16 { return id }, nil},
+		{"tcp id mismatch", func(id uint16) uint16 { return id + 1 }, errIDMismatch},
+	} {
+		addr, stop := fakeUpstream(t, c.tcpID)
+		resp, err := newUpstream(addr, 1232).exchange(testQuery(7, "big.example."), time.Second)
+		stop()
+		if err != c.err {
+			t.Errorf("%v: got error %v, want %v", c.name, err, c.err)
+			continue
+		}
+		if err == nil && (resp.Truncated || len(resp.Answers) != 1) {
+			t.Errorf("%v: got truncated=%v answers=%v, want the full tcp answer", c.name, resp.Truncated, resp.Answers)
+		}
+	}
+}
@@ -0,0 +1,73 @@
+package svc
+
+import (
+	"errors"
+	"net"
+	"strings"
+	"time"
+
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+var errNoUpstream = errors.New("no upstream answered")
+
+// upstream 一个上游转发服务器。每次查询使用独立的已连接UDP socket，
+// 源端口由内核随机分配，内核只会把来自该上游地址的报文投递到这个socket
+type upstream struct {
+	addr    net.UDPAddr
+	udpSize int
+	stat    upstreamStat
+}
+
+func newUpstream(addr net.UDPAddr, udpSize int) *upstream {
+	return &upstream{addr: addr, udpSize: udpSize}
+}
+
+// exchange 向上游发送查询并等待应答。ID或问题与查询不一致的报文直接丢弃，
+// 应答被截断(TC)时改用TCP重新查询
+func (u *upstream) exchange(query dnsmessage.Message, timeout time.Duration) (dnsmessage.Message, error) {
+	var resp dnsmessage.Message
+	packed, err := query.Pack()
+	if err != nil {
+		return resp, err
+	}
+	conn, err := net.DialUDP("udp", nil, &u.addr)
+	if err != nil {
+		return resp, err
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(timeout))
+
+	if _, err = conn.Write(packed); err != nil {
+		return resp, err
+	}
+	buf := make([]byte, u.udpSize)
+	for {
+		n, err := conn.Read(buf)
+		if err != nil {
+			return resp, err
+		}
+		if err = resp.Unpack(buf[:n]); err != nil {
+			log.Debugf("drop malformed packet from %v: %v", u.addr.String(), err)
+			continue
+		}
+		if !matchResponse(query, resp) {
+			log.Debugf("drop mismatched response from %v, id=%v", u.addr.String(), resp.ID)
+			continue
+		}
+		break
+	}
+	if resp.Truncated {
+		return exchangeTCP(u.addr, query)
+	}
+	return resp, nil
+}
+
+// matchResponse 检查应答的ID和问题是否与查询一致
+func matchResponse(query, resp dnsmessage.Message) bool {
+	if !resp.Response || resp.ID != query.ID || len(resp.Questions) != 1 || len(query.Questions) != 1 {
+		return false
+	}
+	q, r := query.Questions[0], resp.Questions[0]
+	return q.Type == r.Type && q.Class == r.Class && strings.EqualFold(q.Name.String(), r.Name.String())
+}
@@ -0,0 +1,82 @@
+package svc
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+// forgedAnswer 返回对q的应答，rdata为addr，edit用于篡改报文
+func forgedAnswer(t *testing.T, q dnsmessage.Message, addr string, edit func(*dnsmessage.Message)) []byte {
+	m := responseTo(q)
+	m.Questions = append([]dnsmessage.Question(nil), q.Questions...)
+	_, r := testRecord(t, q.Questions[0].Name.String(), addr)
+	m.Answers = []dnsmessage.Resource{r}
+	if edit != nil {
+		edit(&m)
+	}
+	packed, err := m.Pack()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return packed
+}
+
+func TestExchangeSpoofed(t *testing.T) {
+	spoofer, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer spoofer.Close()
+
+	for _, c := range []struct {
+		name  string
+		other bool //从上游以外的地址发送
+		edit  func(*dnsmessage.Message)
+		raw   []byte
+	}{
+		{name: "other source", other: true},
+		{name: "id mismatch", edit: func(m *dnsmessage.Message) { m.ID++ }},
+		{name: "question mismatch", edit: func(m *dnsmessage.Message) { m.Questions[0].Name = dnsmessage.MustNewName("evil.example.") }},
+		{name: "type mismatch", edit: func(m *dnsmessage.Message) { m.Questions[0].Type = dnsmessage.TypeAAAA }},
+		{name: "not a response", edit: func(m *dnsmessage.Message) { m.Response = false }},
+		{name: "malformed", raw: []byte{0, 1, 2}},
+	} {
+		uc, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+		if err != nil {
+			t.Fatal(err)
+		}
+		go func() {
+			buf := make([]byte, 512)
+			n, from, err := uc.ReadFromUDP(buf)
+			var q dnsmessage.Message
+			if err != nil || q.Unpack(buf[:n]) != nil {
+				return
+			}
+			//先发送伪造的应答，再发送真正的应答
+			forged := c.raw
+			if forged == nil {
+				forged = forgedAnswer(t, q, "198.51.100.1", c.edit)
+			}
+			if c.other {
+				spoofer.WriteToUDP(forged, from)
+			} else {
+				uc.WriteToUDP(forged, from)
+			}
+			time.Sleep(10 * time.Millisecond)
+			uc.WriteToUDP(forgedAnswer(t, q, "192.0.2.9", nil), from)
+		}()
+
+		resp, err := newUpstream(*uc.LocalAddr().(*net.UDPAddr), 1232).exchange(testQuery(7, "www.example."), time.Second)
+		uc.Close()
+		if err != nil {
+			t.Errorf("%v: %v", c.name, err)
+			continue
+		}
+		if len(resp.Answers) != 1 || resp.Answers[0].Body.(*dnsmessage.AResource).A != [4]byte{192, 0, 2, 9} {
+			t.Errorf("%v: accepted forged answer %v", c.name, resp.Answers)
+		}
+	}
+}
@@ -0,0 +1,133 @@
+package svc
+
+import (
+	"fmt"
+	"math"
+	"net/http"
+	"strings"
+
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+const (
+	maxNameLength  = 253 //不含结尾.的名称长度
+	maxLabelLength = 63
+	maxTTL         = math.MaxInt32 //RFC 2181 8: TTL的最高位为0
+)
+
+// recordTypes 可以通过REST写入的类型
+var recordTypes = []dnsmessage.Type{
+	dnsmessage.TypeA, dnsmessage.TypeNS, dnsmessage.TypeCNAME, dnsmessage.TypeSOA, dnsmessage.TypePTR,
+	dnsmessage.TypeMX, dnsmessage.TypeAAAA, dnsmessage.TypeSRV, dnsmessage.TypeTXT,
+}
+
+// rrsetReader Backend和Tx共有的读取方法
+type rrsetReader interface {
+	Get(key string) ([]dnsmessage.Resource, bool)
+}
+
+// conflictError 与已有记录冲突，REST接口返回409，其他校验错误返回400
+type conflictError string
+
+func (e conflictError) Error() string { return string(e) }
+
+func validationStatus(err error) int {
+	if _, ok := err.(conflictError); ok {
+		return http.StatusConflict
+	}
+	return http.StatusBadRequest
+}
+
+// validateRecord 检查REST写入的记录r，old为被r替换的记录：名称和TTL合法，
+// 同名只能有一条CNAME，并且CNAME不能与同名的其他记录共存(RFC 1034 3.6.2)
+func validateRecord(book rrsetReader, r dnsmessage.Resource, old *dnsmessage.Resource) error {
+	if err := checkRecord(r); err != nil {
+		return err
+	}
+	if r.Header.Type == dnsmessage.TypeCNAME {
+		rs, _ := book.Get(ntString(r.Header.Name, r.Header.Type))
+		for _, rec := range rs {
+			if rString(rec) != rString(r) && (old == nil || rString(rec) != rString(*old)) {
+				return conflictError(fmt.Sprintf("%v already has a CNAME record", r.Header.Name))
+			}
+		}
+	}
+	return checkCNAMEConflict(book, r.Header.Name, r.Header.Type)
+}
+
+// validateRRset 检查整体替换name的type类型RRset的记录rs
+func validateRRset(book rrsetReader, name dnsmessage.Name, rtype dnsmessage.Type, rs []dnsmessage.Resource) error {
+	for _, r := range rs {
+		if err := checkRecord(r); err != nil {
+			return err
+		}
+	}
+	if len(rs) == 0 {
+		return nil
+	}
+	if rtype == dnsmessage.TypeCNAME && len(dedupe(rs)) > 1 {
+		return conflictError(fmt.Sprintf("%v can only have one CNAME record", name))
+	}
+	return checkCNAMEConflict(book, name, rtype)
+}
+
+// checkCNAMEConflict 写入CNAME时名称下不能有其他类型，写入其他类型时不能有CNAME
+func checkCNAMEConflict(book rrsetReader, name dnsmessage.Name, rtype dnsmessage.Type) error {
+	for _, t := range recordTypes {
+		if t == rtype || (rtype != dnsmessage.TypeCNAME && t != dnsmessage.TypeCNAME) {
+			continue
+		}
+		if _, ok := book.Get(ntString(name, t)); ok {
+			return conflictError(fmt.Sprintf("CNAME and other data at %v", name))
+		}
+	}
+	return nil
+}
+
+// checkRecord 检查记录的TTL，名称以及数据中的名称
+func checkRecord(r dnsmessage.Resource) error {
+	if r.Header.TTL > maxTTL {
+		return fmt.Errorf("TTL %v out of range [0, %v]", r.Header.TTL, maxTTL)
+	}
+	names := []dnsmessage.Name{r.Header.Name}
+	switch b := r.Body.(type) {
+	case *dnsmessage.NSResource:
+		names = append(names, b.NS)
+	case *dnsmessage.CNAMEResource:
+		names = append(names, b.CNAME)
+	case *dnsmessage.PTRResource:
+		names = append(names, b.PTR)
+	case *dnsmessage.MXResource:
+		names = append(names, b.MX)
+	case *dnsmessage.SRVResource:
+		names = append(names, b.Target)
+	case *dnsmessage.SOAResource:
+		names = append(names, b.NS, b.MBox)
+	}
+	for _, n := range names {
+		if err := checkName(n.String()); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// checkName 检查名称长度和每个label的长度，名称必须以.结尾
+func checkName(name string) error {
+	if name == "." {
+		return nil
+	}
+	if !strings.HasSuffix(name, ".") {
+		return fmt.Errorf("name %q is not fully qualified", name)
+	}
+	name = strings.TrimSuffix(name, ".")
+	if len(name) > maxNameLength {
+		return fmt.Errorf("name %q longer than %v bytes", name, maxNameLength)
+	}
+	for _, label := range strings.Split(name, ".") {
+		if label == "" || len(label) > maxLabelLength {
+			return fmt.Errorf("name %q has an empty label or a label longer than %v bytes", name, maxLabelLength)
+		}
+	}
+	return nil
+}
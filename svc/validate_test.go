@@ -0,0 +1,51 @@
+package svc
+
+import (
+	"net/http"
+	"strings"
+	"testing"
+
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+func TestValidation(t *testing.T) {
+	rest := testRestService()
+	long := strings.Repeat("a", 64)
+	cases := []struct {
+		url, body string
+		code      int
+	}{
+		{"/v1/records/www.example.com/A", `{"TTL":600,"Data":"192.0.2.1"}`, http.StatusCreated},
+		{"/v1/records/www.example.com/CNAME", `{"TTL":600,"Data":"example.com."}`, http.StatusConflict},
+		{"/v1/records/v6.example.com/A", `{"TTL":600,"Data":"2001:db8::1"}`, http.StatusBadRequest},
+		{"/v1/records/v4.example.com/AAAA", `{"TTL":600,"Data":"192.0.2.1"}`, http.StatusBadRequest},
+		{"/v1/records/ttl.example.com/A", `{"TTL":4294967295,"Data":"192.0.2.1"}`, http.StatusBadRequest},
+		{"/v1/records/" + long + ".example.com/A", `{"TTL":600,"Data":"192.0.2.1"}`, http.StatusBadRequest},
+		{"/v1/records/mx.example.com/MX", `{"TTL":600,"MX":{"Pref":10,"MX":"` + long + `.example.com."}}`, http.StatusBadRequest},
+		{"/v1/records/alias.example.com/CNAME", `{"TTL":600,"Data":"www.example.com."}`, http.StatusCreated},
+		{"/v1/records/alias.example.com/CNAME", `{"TTL":600,"Data":"mail.example.com."}`, http.StatusConflict},
+		{"/v1/records/alias.example.com/TXT", `{"TTL":600,"TXT":["x"]}`, http.StatusConflict},
+		{"/v1/records/Mixed.Example.COM/CNAME", `{"TTL":600,"Data":"WWW.Example.com."}`, http.StatusCreated},
+		{"/v1/records/mixed.example.com/A", `{"TTL":600,"Data":"192.0.2.1"}`, http.StatusConflict},
+		{"/v1/records/MIXED.example.com/CNAME", `{"TTL":600,"Data":"www.example.com."}`, http.StatusConflict}, //大小写不同的同一条记录
+	}
+	for _, c := range cases {
+		if w := doV1(rest, http.MethodPost, c.url, c.body); w.Code != c.code {
+			t.Errorf("POST %v %v: got %v %v, want %v", c.url, c.body, w.Code, w.Body, c.code)
+		}
+	}
+
+	rs, _ := rest.Dn.book.Get(ntString(dnsmessage.MustNewName("mixed.example.com."), dnsmessage.TypeCNAME))
+	if len(rs) != 1 || rs[0].Body.(*dnsmessage.CNAMEResource).CNAME.String() != "www.example.com." {
+		t.Errorf("mixed-case record is not stored in lower case: %v", rs)
+	}
+
+	w := doV1(rest, http.MethodPut, "/v1/records/alias.example.com/CNAME", `[{"TTL":600,"Data":"a.example.com."},{"TTL":600,"Data":"b.example.com."}]`)
+	if w.Code != http.StatusConflict {
+		t.Errorf("put two CNAMEs: %v, want 409", w.Code)
+	}
+	w = doV1(rest, http.MethodPut, "/v1/records/dup.example.com/A", `[{"TTL":600,"Data":"192.0.2.1"},{"TTL":300,"Data":"192.0.2.1"}]`)
+	if w.Code != http.StatusCreated || strings.Count(w.Body.String(), "192.0.2.1") != 1 {
+		t.Errorf("put duplicates: %v %v", w.Code, w.Body)
+	}
+}
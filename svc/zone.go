@@ -0,0 +1,223 @@
+package svc
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+const maxCNAMEChain = 8
+
+// zone 从zone文件加载的权威区，与转发缓存相互独立
+type zone struct {
+	origin  string
+	soa     dnsmessage.Resource
+	records map[string]map[dnsmessage.Type][]dnsmessage.Resource
+	names   map[string]bool //区内存在的所有名称，包括没有记录的中间节点(empty non-terminal)
+}
+
+type zoneStore struct {
+	sync.RWMutex
+	zones map[string]*zone
+}
+
+// newZone 根据记录构建zone，origin处必须有且只有一条SOA记录
+func newZone(origin string, rs []dnsmessage.Resource) (*zone, error) {
+	z := &zone{
+		origin:  origin,
+		records: make(map[string]map[dnsmessage.Type][]dnsmessage.Resource),
+		names:   map[string]bool{origin: true},
+	}
+	for _, r := range rs {
+		name := canonicalName(r.Header.Name.String())
+		if !inZone(name, origin) {
+			return nil, fmt.Errorf("zone %v: %v is out of zone", origin, name)
+		}
+		if r.Header.Type == dnsmessage.TypeSOA {
+			if name != origin || z.soa.Body != nil {
+				return nil, fmt.Errorf("zone %v: unexpected SOA at %v", origin, name)
+			}
+			z.soa = r
+		}
+		if z.records[name] == nil {
+			z.records[name] = make(map[dnsmessage.Type][]dnsmessage.Resource)
+		}
+		z.records[name][r.Header.Type] = append(z.records[name][r.Header.Type], r)
+		for n := name; n != origin; n = parentName(n) {
+			z.names[n] = true
+		}
+	}
+	if z.soa.Body == nil {
+		return nil, fmt.Errorf("zone %v: missing SOA", origin)
+	}
+	return z, nil
+}
+
+// inZone 判断name是否等于origin或位于origin之下
+func inZone(name, origin string) bool {
+	return origin == "." || name == origin || strings.HasSuffix(name, "."+origin)
+}
+
+// parentName 返回去掉最左一个label后的名称
+func parentName(name string) string {
+	if i := strings.Index(name, "."); i >= 0 && i < len(name)-1 {
+		return name[i+1:]
+	}
+	return "."
+}
+
+// load 加载目录下的所有zone文件并整体替换，文件中没有$ORIGIN时以去掉
+// .zone/.db后缀的文件名作为origin。加载失败的zone记录日志后跳过
+func (zs *zoneStore) load(dir string) {
+	zones := make(map[string]*zone)
+	if dir != "" {
+		for _, file := range queryFiles(dir) {
+			origin := strings.TrimSuffix(strings.TrimSuffix(filepath.Base(file), ".zone"), ".db")
+			z, err := loadZoneFile(file, origin)
+			if err != nil {
+				log.Errorf("load zone file error: %v", err)
+				continue
+			}
+			if _, ok := zones[z.origin]; ok {
+				log.Errorf("load zone file %v error: duplicate zone %v", file, z.origin)
+				continue
+			}
+			zones[z.origin] = z
+			log.Infof("load zone %v from %v, %v names", z.origin, file, len(z.names))
+		}
+	}
+	zs.Lock()
+	zs.zones = zones
+	zs.Unlock()
+}
+
+func loadZoneFile(file, origin string) (*zone, error) {
+	f, err := os.Open(file)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	rs, err := parseZone(f, origin, file)
+	if err != nil {
+		return nil, err
+	}
+	for _, r := range rs {
+		if r.Header.Type == dnsmessage.TypeSOA {
+			origin = r.Header.Name.String()
+			break
+		}
+	}
+	return newZone(canonicalName(origin), rs)
+}
+
+// find 返回包含name的最具体的zone
+func (zs *zoneStore) find(name string) *zone {
+	name = canonicalName(name)
+	zs.RLock()
+	defer zs.RUnlock()
+	if len(zs.zones) == 0 {
+		return nil
+	}
+	for n := name; ; n = parentName(n) {
+		if z, ok := zs.zones[n]; ok {
+			return z
+		}
+		if n == "." {
+			return nil
+		}
+	}
+}
+
+// answer 填充权威应答：命中时设置AA位；名称不存在返回NXDOMAIN，
+// 名称存在但没有该类型返回NODATA，两者都在authority段附带SOA
+func (z *zone) answer(q dnsmessage.Question, m *dnsmessage.Message) {
+	m.Authoritative = true
+	name := canonicalName(q.Name.String())
+	for i := 0; i < maxCNAMEChain; i++ { //区内的CNAME链继续解析
+		if ns := z.delegation(name); ns != nil { //委派给子域，返回referral
+			m.Authoritative = false
+			m.Authorities = append(m.Authorities, ns...)
+			return
+		}
+		rrs, exists := z.rrsets(name)
+		if !exists {
+			m.RCode = dnsmessage.RCodeNameError
+			m.Authorities = append(m.Authorities, z.negativeSOA())
+			return
+		}
+		if q.Type == dnsmessage.TypeALL {
+			for _, rs := range rrs {
+				m.Answers = append(m.Answers, withOwner(rs, q.Name)...)
+			}
+			return
+		}
+		if rs := rrs[q.Type]; len(rs) > 0 {
+			m.Answers = append(m.Answers, withOwner(rs, q.Name)...)
+			return
+		}
+		cname := rrs[dnsmessage.TypeCNAME]
+		if len(cname) == 0 {
+			m.Authorities = append(m.Authorities, z.negativeSOA())
+			return
+		}
+		m.Answers = append(m.Answers, withOwner(cname, q.Name)...)
+		name = canonicalName(cname[0].Body.(*dnsmessage.CNAMEResource).CNAME.String())
+		if !inZone(name, z.origin) { //区外的目标由client自行解析
+			return
+		}
+		q.Name, _ = dnsmessage.NewName(name)
+	}
+}
+
+// rrsets 查找name的记录，name不存在时按RFC 4592尝试最近祖先下的通配符
+func (z *zone) rrsets(name string) (map[dnsmessage.Type][]dnsmessage.Resource, bool) {
+	if z.names[name] {
+		return z.records[name], true
+	}
+	for n := parentName(name); inZone(n, z.origin); n = parentName(n) {
+		if z.names[n] {
+			rrs, ok := z.records["*."+n]
+			return rrs, ok
+		}
+		if n == z.origin {
+			break
+		}
+	}
+	return nil, false
+}
+
+// delegation 如果name位于区内某个子域委派之下，返回该子域的NS记录
+func (z *zone) delegation(name string) []dnsmessage.Resource {
+	for n := name; n != z.origin && inZone(n, z.origin); n = parentName(n) {
+		if ns := z.records[n][dnsmessage.TypeNS]; len(ns) > 0 {
+			return ns
+		}
+	}
+	return nil
+}
+
+// negativeSOA 用于否定应答的SOA，TTL取SOA的TTL与MINIMUM中较小者(RFC 2308)
+func (z *zone) negativeSOA() dnsmessage.Resource {
+	soa := z.soa
+	if min := soa.Body.(*dnsmessage.SOAResource).MinTTL; min < soa.Header.TTL {
+		soa.Header.TTL = min
+	}
+	return soa
+}
+
+// withOwner 通配符命中时把记录的owner替换为查询的名称
+func withOwner(rs []dnsmessage.Resource, name dnsmessage.Name) []dnsmessage.Resource {
+	if len(rs) == 0 || !strings.HasPrefix(rs[0].Header.Name.String(), "*.") {
+		return rs
+	}
+	out := make([]dnsmessage.Resource, len(rs))
+	for i, r := range rs {
+		r.Header.Name = name
+		out[i] = r
+	}
+	return out
+}
@@ -0,0 +1,331 @@
+package svc
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+const defaultZoneTTL uint32 = 3600
+
+// zoneParser 解析RFC 1035 5章定义的master文件格式，支持$ORIGIN，$TTL，
+// 相对名称，@，省略owner，括号跨行以及;注释
+type zoneParser struct {
+	file   string
+	origin string
+	ttl    uint32 //$TTL或上一条记录的TTL
+	hasTTL bool
+	owner  string //上一条记录的owner，省略owner时沿用
+	lineNo int
+	noOrig bool //当前记录中出现了无法补全的相对名称
+}
+
+// parseZone 解析zone文件，origin为$ORIGIN出现前使用的默认origin
+func parseZone(r io.Reader, origin, file string) ([]dnsmessage.Resource, error) {
+	zp := &zoneParser{file: file, origin: canonicalName(origin), ttl: defaultZoneTTL}
+	var rs []dnsmessage.Resource
+
+	scanner := bufio.NewScanner(r)
+	var tokens []string
+	var blankOwner bool
+	depth, startLine := 0, 0
+	for scanner.Scan() {
+		zp.lineNo++
+		line := scanner.Text()
+		if depth == 0 {
+			startLine = zp.lineNo
+			blankOwner = len(line) > 0 && (line[0] == ' ' || line[0] == '\t')
+		}
+		toks, d, err := tokenize(line, depth)
+		if err != nil {
+			return nil, zp.errorf("%v", err)
+		}
+		tokens, depth = append(tokens, toks...), d
+		if depth > 0 || len(tokens) == 0 {
+			continue
+		}
+		entryLine := zp.lineNo
+		zp.lineNo = startLine
+		r, ok, err := zp.entry(tokens, blankOwner)
+		if err != nil {
+			return nil, err
+		}
+		zp.lineNo = entryLine
+		if ok {
+			rs = append(rs, r)
+		}
+		tokens = nil
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	if depth > 0 {
+		return nil, zp.errorf("unbalanced parentheses")
+	}
+	return rs, nil
+}
+
+func (zp *zoneParser) errorf(format string, args ...interface{}) error {
+	return fmt.Errorf("%v:%v: %v", zp.file, zp.lineNo, fmt.Sprintf(format, args...))
+}
+
+// tokenize 切分一行，处理引号，转义，注释和括号，返回新的括号深度。
+// 引号内的内容作为一个token，以"开头以便与普通token区分
+func tokenize(line string, depth int) (tokens []string, newDepth int, err error) {
+	var cur strings.Builder
+	quoted, inTok := false, false
+	flush := func() {
+		if inTok {
+			tokens = append(tokens, cur.String())
+			cur.Reset()
+			inTok = false
+		}
+	}
+	for i := 0; i < len(line); i++ {
+		c := line[i]
+		switch {
+		case c == '\\' && i+1 < len(line):
+			cur.WriteByte(c)
+			cur.WriteByte(line[i+1])
+			inTok = true
+			i++
+		case quoted:
+			if c == '"' {
+				quoted = false
+				tokens = append(tokens, cur.String())
+				cur.Reset()
+				inTok = false
+			} else {
+				cur.WriteByte(c)
+			}
+		case c == '"':
+			flush()
+			quoted = true
+			inTok = true
+			cur.WriteByte('"')
+		case c == ';':
+			flush()
+			return tokens, depth, nil
+		case c == '(':
+			flush()
+			depth++
+		case c == ')':
+			flush()
+			if depth == 0 {
+				return nil, depth, fmt.Errorf("unexpected )")
+			}
+			depth--
+		case c == ' ' || c == '\t':
+			flush()
+		default:
+			cur.WriteByte(c)
+			inTok = true
+		}
+	}
+	if quoted {
+		return nil, depth, fmt.Errorf("unterminated quoted string")
+	}
+	flush()
+	return tokens, depth, nil
+}
+
+// entry 处理一条逻辑记录，ok为false表示是$指令
+func (zp *zoneParser) entry(tokens []string, blankOwner bool) (r dnsmessage.Resource, ok bool, err error) {
+	switch strings.ToUpper(tokens[0]) {
+	case "$ORIGIN":
+		if len(tokens) < 2 {
+			return r, false, zp.errorf("$ORIGIN needs a name")
+		}
+		zp.origin = zp.qualify(tokens[1])
+		return r, false, nil
+	case "$TTL":
+		if len(tokens) < 2 {
+			return r, false, zp.errorf("$TTL needs a value")
+		}
+		if zp.ttl, err = parseTTL(tokens[1]); err != nil {
+			return r, false, zp.errorf("%v", err)
+		}
+		zp.hasTTL = true
+		return r, false, nil
+	case "$INCLUDE", "$GENERATE":
+		return r, false, zp.errorf("%v is not supported", tokens[0])
+	}
+
+	zp.noOrig = false
+	if !blankOwner {
+		zp.owner = zp.qualify(tokens[0])
+		tokens = tokens[1:]
+	} else if zp.owner == "" {
+		return r, false, zp.errorf("record without owner")
+	}
+
+	ttl := zp.ttl
+	for len(tokens) > 0 {
+		if strings.EqualFold(tokens[0], "IN") {
+			tokens = tokens[1:]
+			continue
+		}
+		if t, err := parseTTL(tokens[0]); err == nil && tokens[0][0] >= '0' && tokens[0][0] <= '9' {
+			ttl = t
+			if !zp.hasTTL {
+				zp.ttl = t //没有$TTL时沿用上一条显式指定的TTL
+			}
+			tokens = tokens[1:]
+			continue
+		}
+		break
+	}
+	if len(tokens) == 0 {
+		return r, false, zp.errorf("missing record type")
+	}
+
+	req := request{Host: zp.owner, TTL: ttl, Type: strings.ToUpper(tokens[0])}
+	rdata := tokens[1:]
+	need := map[string]int{"A": 1, "AAAA": 1, "NS": 1, "CNAME": 1, "PTR": 1, "MX": 2, "SRV": 4, "SOA": 7, "TXT": 1}
+	n, known := need[req.Type]
+	if !known {
+		return r, false, zp.errorf("unsupported record type %v", req.Type)
+	}
+	if len(rdata) < n {
+		return r, false, zp.errorf("%v record needs %v fields, got %v", req.Type, n, len(rdata))
+	}
+
+	switch req.Type {
+	case "A", "AAAA":
+		req.Data = rdata[0]
+	case "NS", "CNAME", "PTR":
+		req.Data = zp.qualify(rdata[0])
+	case "MX":
+		pref, err := strconv.ParseUint(rdata[0], 10, 16)
+		if err != nil {
+			return r, false, zp.errorf("invalid MX preference %q", rdata[0])
+		}
+		req.MX = requestMX{Pref: uint16(pref), MX: zp.qualify(rdata[1])}
+	case "SRV":
+		var v [3]uint64
+		for i := range v {
+			if v[i], err = strconv.ParseUint(rdata[i], 10, 16); err != nil {
+				return r, false, zp.errorf("invalid SRV field %q", rdata[i])
+			}
+		}
+		req.SRV = requestSRV{Priority: uint16(v[0]), Weight: uint16(v[1]), Port: uint16(v[2]), Target: zp.qualify(rdata[3])}
+	case "SOA":
+		var v [5]uint32
+		for i := range v {
+			if v[i], err = parseTTL(rdata[2+i]); err != nil {
+				return r, false, zp.errorf("invalid SOA field %q", rdata[2+i])
+			}
+		}
+		req.SOA = requestSOA{NS: zp.qualify(rdata[0]), MBox: zp.qualify(rdata[1]),
+			Serial: v[0], Refresh: v[1], Retry: v[2], Expire: v[3], MinTTL: v[4]}
+	case "TXT":
+		for _, s := range rdata {
+			req.TXT = append(req.TXT, unescape(strings.TrimPrefix(s, "\"")))
+		}
+	}
+
+	if zp.noOrig {
+		return r, false, zp.errorf("relative name without $ORIGIN")
+	}
+	if r, err = toResource(req); err != nil {
+		return r, false, zp.errorf("%v %v: %v", req.Host, req.Type, err)
+	}
+	return r, true, nil
+}
+
+// qualify 把相对名称补全为绝对名称
+func (zp *zoneParser) qualify(name string) string {
+	if name == "@" {
+		zp.noOrig = zp.origin == ""
+		return zp.origin
+	}
+	if strings.HasSuffix(name, ".") && !strings.HasSuffix(name, "\\.") {
+		return canonicalName(name)
+	}
+	if zp.origin == "" {
+		zp.noOrig = true
+		return name
+	}
+	if zp.origin == "." {
+		return canonicalName(name + ".")
+	}
+	return canonicalName(name + "." + zp.origin)
+}
+
+// parseTTL 解析TTL，支持纯秒数以及1w2d3h4m5s形式
+func parseTTL(s string) (uint32, error) {
+	if n, err := strconv.ParseUint(s, 10, 32); err == nil {
+		return uint32(n), nil
+	}
+	var total, cur uint64
+	digits := false
+	for _, c := range strings.ToLower(s) {
+		if c >= '0' && c <= '9' {
+			cur = cur*10 + uint64(c-'0')
+			digits = true
+			continue
+		}
+		if !digits {
+			return 0, fmt.Errorf("invalid ttl %q", s)
+		}
+		switch c {
+		case 's':
+		case 'm':
+			cur *= 60
+		case 'h':
+			cur *= 3600
+		case 'd':
+			cur *= 86400
+		case 'w':
+			cur *= 604800
+		default:
+			return 0, fmt.Errorf("invalid ttl %q", s)
+		}
+		total += cur
+		cur, digits = 0, false
+	}
+	if digits || total > 0xffffffff {
+		return 0, fmt.Errorf("invalid ttl %q", s)
+	}
+	return uint32(total), nil
+}
+
+// unescape 处理\X和\DDD转义
+func unescape(s string) string {
+	if !strings.Contains(s, "\\") {
+		return s
+	}
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		if s[i] != '\\' || i+1 >= len(s) {
+			b.WriteByte(s[i])
+			continue
+		}
+		if i+3 < len(s) {
+			if n, err := strconv.ParseUint(s[i+1:i+4], 10, 8); err == nil {
+				b.WriteByte(byte(n))
+				i += 3
+				continue
+			}
+		}
+		b.WriteByte(s[i+1])
+		i++
+	}
+	return b.String()
+}
+
+// canonicalName 统一为小写并以.结尾
+func canonicalName(name string) string {
+	if name == "" {
+		return ""
+	}
+	name = strings.ToLower(name)
+	if !strings.HasSuffix(name, ".") {
+		name += "."
+	}
+	return name
+}
@@ -0,0 +1,116 @@
+package svc
+
+import (
+	"strings"
+	"testing"
+
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+const testZone = `
+$ORIGIN example.com.
+$TTL 1h
+@   IN  SOA ns1 hostmaster (
+        2021110501 ; serial
+        3600       ; refresh
+        900        ; retry
+        1w         ; expire
+        300 )      ; minimum
+    IN  NS  ns1
+    IN  MX  10 mail
+ns1     A   192.0.2.1
+mail 600 IN A 192.0.2.2
+www     CNAME mail
+txt     TXT "v=spf1 mx -all" "second\"string"
+_sip._tcp SRV 10 60 5060 sip
+a.b.c   AAAA 2001:db8::1
+*.wild  A 192.0.2.9
+sub     NS  ns.sub
+ns.sub  A   192.0.2.53
+`
+
+func testQuestion(name string, t dnsmessage.Type) dnsmessage.Question {
+	return dnsmessage.Question{Name: dnsmessage.MustNewName(name), Type: t, Class: dnsmessage.ClassINET}
+}
+
+func TestParseZone(t *testing.T) {
+	rs, err := parseZone(strings.NewReader(testZone), "", "test.zone")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(rs) != 12 {
+		t.Fatalf("got %v records, want 12", len(rs))
+	}
+	soa := rs[0].Body.(*dnsmessage.SOAResource)
+	if soa.NS.String() != "ns1.example.com." || soa.Expire != 604800 || soa.MinTTL != 300 {
+		t.Errorf("bad SOA %v", soa.GoString())
+	}
+	if rs[1].Header.Name.String() != "example.com." || rs[1].Header.TTL != 3600 {
+		t.Errorf("blank owner or $TTL not applied: %v", rs[1].Header.GoString())
+	}
+	if rs[4].Header.TTL != 600 {
+		t.Errorf("explicit TTL not applied: %v", rs[4].Header.GoString())
+	}
+	txt := rs[6].Body.(*dnsmessage.TXTResource).TXT
+	if len(txt) != 2 || txt[0] != "v=spf1 mx -all" || txt[1] != `second"string` {
+		t.Errorf("bad TXT %q", txt)
+	}
+
+	if _, err := parseZone(strings.NewReader("www A 192.0.2.1\n"), "", "bad.zone"); err == nil {
+		t.Error("relative name without origin should fail")
+	}
+	if _, err := parseZone(strings.NewReader("$ORIGIN x.\n@ SOA a b (1 2 3 4 5\n"), "", "bad.zone"); err == nil {
+		t.Error("unbalanced parentheses should fail")
+	}
+}
+
+func TestZoneAnswer(t *testing.T) {
+	rs, err := parseZone(strings.NewReader(testZone), "", "test.zone")
+	if err != nil {
+		t.Fatal(err)
+	}
+	z, err := newZone("example.com.", rs)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cases := []struct {
+		name    string
+		qtype   dnsmessage.Type
+		rcode   dnsmessage.RCode
+		aa      bool
+		answers int
+		auth    dnsmessage.Type
+	}{
+		{"mail.example.com.", dnsmessage.TypeA, dnsmessage.RCodeSuccess, true, 1, 0},
+		{"WWW.example.com.", dnsmessage.TypeA, dnsmessage.RCodeSuccess, true, 2, 0},
+		{"mail.example.com.", dnsmessage.TypeAAAA, dnsmessage.RCodeSuccess, true, 0, dnsmessage.TypeSOA},
+		{"b.c.example.com.", dnsmessage.TypeA, dnsmessage.RCodeSuccess, true, 0, dnsmessage.TypeSOA},
+		{"nope.example.com.", dnsmessage.TypeA, dnsmessage.RCodeNameError, true, 0, dnsmessage.TypeSOA},
+		{"x.wild.example.com.", dnsmessage.TypeA, dnsmessage.RCodeSuccess, true, 1, 0},
+		{"host.sub.example.com.", dnsmessage.TypeA, dnsmessage.RCodeSuccess, false, 0, dnsmessage.TypeNS},
+	}
+	for _, c := range cases {
+		q := testQuestion(c.name, c.qtype)
+		var m dnsmessage.Message
+		z.answer(q, &m)
+		if m.RCode != c.rcode || m.Authoritative != c.aa || len(m.Answers) != c.answers {
+			t.Errorf("%v %v: rcode=%v aa=%v answers=%v", c.name, c.qtype, m.RCode, m.Authoritative, len(m.Answers))
+			continue
+		}
+		if c.auth != 0 && (len(m.Authorities) == 0 || m.Authorities[0].Header.Type != c.auth) {
+			t.Errorf("%v %v: want %v in authority, got %v", c.name, c.qtype, c.auth, m.Authorities)
+		}
+		if c.auth == dnsmessage.TypeSOA && m.Authorities[0].Header.TTL != 300 {
+			t.Errorf("%v: negative SOA ttl %v, want 300", c.name, m.Authorities[0].Header.TTL)
+		}
+	}
+
+	for _, qtype := range []dnsmessage.Type{dnsmessage.TypeA, dnsmessage.TypeALL} {
+		var m dnsmessage.Message
+		z.answer(testQuestion("x.wild.example.com.", qtype), &m)
+		if len(m.Answers) == 0 || m.Answers[0].Header.Name.String() != "x.wild.example.com." {
+			t.Errorf("%v: wildcard owner not rewritten: %v", qtype, m.Answers)
+		}
+	}
+}